@@ -4,138 +4,372 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
-	"strconv"
 	"strings"
+	"time"
+
+	"github.com/cpfair/go-teamcity-report/teamcity"
 )
 
-// This converts standard Go test output to be all pretty in TeamCity
-// TeamCity reporting format: https://confluence.jetbrains.com/display/TCD7/Build+Script+Interaction+with+TeamCity#BuildScriptInteractionwithTeamCity-ReportingTests
-// Go test output is of the following form:
-//
-// === RUN testname
-// --- (PASS|FAIL|SKIP): testname (1.23s)
-// [failure output if applicable]
-// ...
-// (PASS|FAIL) [appears at the end of a succesful package of tests]
-// (ok|FAIL|?) packagename (4.56s)
-//
-// Unfortunately, stdout just gets plastered wherever, especially during parallel tests. Yay go?
-// Also unfortunately, we can't report completely realtime since we don't know the package name until it completes.
+// What -go-version can be, e.g. 1.22, go1.22 or 1.22.3
+var goVersionPattern = regexp.MustCompile(`^(?:go)?1\.\d+(?:\.\d+)?$`)
+
+// What the flags default to, where that isn't the zero value
+var defaults = teamcity.DefaultOptions()
 
 var (
-	// For parsing
-	testRunPattern       = regexp.MustCompile(`^=== RUN\s+(\S+)`)
-	testFinishPattern    = regexp.MustCompile(`^--- (PASS|FAIL|SKIP):\s+(\S+) \(([\d.]+)s\)`)
-	packageFinishPattern = regexp.MustCompile(`^(ok|FAIL|\?)\s+(\S+)`)
-	cruftPattern         = regexp.MustCompile(`^(PASS|FAIL)$`)
-	// For escaping
-	specialCharsPattern  = regexp.MustCompile(`\n|\r|\[|\]|\||'`)
-	nonAsciiCharsPattern = regexp.MustCompile(`[\x00-\x20]|[\x80-\x{ffff}]`)
+	jsonInput     = flag.Bool("json", false, "read the output of `go test -json` rather than `go test -v`")
+	ginkgoInput   = flag.Bool("ginkgo", false, "read the output of Ginkgo specs run with -ginkgo.v, reporting each container as a suite")
+	inputPath     = flag.String("input", "", "read from this file rather than stdin, as can be any files given as arguments")
+	fifo          = flag.Bool("fifo", false, "read -input, a named pipe, through each writer in turn, until one closes it without writing anything, e.g. ': > pipe'")
+	gzipInput     = flag.Bool("gzip", false, "decompress the input, which is assumed when -input ends in .gz")
+	outputPath    = flag.String("output", "", "write to this file rather than stdout")
+	teePath       = flag.String("tee", "", "also copy the input as-is to this file")
+	jsonOutPath   = flag.String("json-out", "", "also write the results as JSON, as -format json would, to this file")
+	quiet         = flag.Bool("quiet", false, "write only service messages, dropping anything else in the input rather than passing it through")
+	stripANSI     = flag.Bool("strip-ansi", defaults.StripANSI, "remove ANSI colour codes from the input")
+	capturePass   = flag.Bool("capture-pass", false, "attach the output of passing tests to them, not just failing ones")
+	captureStdOut = flag.Bool("capture-std-out", defaults.CaptureStandardOutput, "have TeamCity attach everything printed during a test to it, rather than only what we attach explicitly")
+	durationRound = flag.String("duration-round", defaults.DurationRounding, "how to make each test's duration whole milliseconds, round, truncate or ceil")
+	durationMeta  = flag.Bool("duration-metadata", false, "add each test's duration in milliseconds as metadata named durationMs, for charts")
+	timestamps    = flag.Bool("timestamps", false, "add when each test started and finished to its service messages")
+	include       = flag.String("include", "", "only report tests whose full name (e.g. TestFoo/bar) matches this regular expression")
+	exclude       = flag.String("exclude", "", "don't report tests whose full name matches this regular expression")
+	artifacts     = flag.String("artifacts", "", "link files to the tests that mention them in output matching this regular expression, whose last group is the path, e.g. 'ARTIFACT: (\\S+)'")
+	messagePat    = flag.String("message-pattern", "", "take a failing test's message from its output matching this regular expression, or its first group, e.g. 'FAILURE REASON: (.*)'")
+	failOnSkip    = flag.Bool("fail-on-skip", false, "report skipped tests as failures")
+	mutedPath     = flag.String("muted", "", "report failures of the tests listed in this file, one full name or * glob per line, as ignored rather than failed")
+	baselinePath  = flag.String("baseline", "", "point out which tests started or stopped failing since the run this -format json report is of")
+	benchBaseline = flag.String("bench-baseline", "", "fail any benchmark that allocates more than it did in the run this -format json report is of")
+	benchThresh   = flag.Float64("bench-threshold", defaults.BenchmarkThreshold, "how much more, as a percentage, a benchmark can allocate than in -bench-baseline")
+	benchAsTests  = flag.Bool("bench-as-tests", false, "report each benchmark as a test too, as well as its statistics, not only those that fail or skip")
+	vet           = flag.Bool("vet", false, "report go vet's findings in the input as inspections")
+	maxDuration   = flag.Int("max-test-duration", 0, "point out tests that take longer than this many milliseconds, 0 for no limit")
+	failSlow      = flag.Bool("fail-slow", false, "fail tests that take longer than -max-test-duration, rather than only pointing them out")
+	summary       = flag.Bool("summary-problem", false, "once all the input has been read, report a build problem saying how many tests failed and naming the first few")
+	goVersion     = flag.String("go-version", "", "the version of Go that ran the tests, e.g. 1.22, to parse its output by rather than guessing at it")
+	strict        = flag.Bool("strict", false, "fail, listing them, if any lines of input weren't recognised as a test's output, a package's setup or anything else")
+	dryRun        = flag.Bool("dry-run", false, "rather than service messages, write an outline of the suites and tests found, for seeing what was made of the input")
+	exitZero      = flag.Bool("exit-zero", false, "exit successfully even if tests failed, leaving TeamCity to notice")
+	format        = flag.String("format", defaults.Format, "what to write the results as, teamcity, junit or json")
+	blocks        = flag.Bool("blocks", false, "put everything written for each package in a collapsible block, holding it until the package finishes")
+	flat          = flag.Bool("flat", false, "report tests by their package and full name, rather than nested in suites")
+	realtime      = flag.Bool("realtime", false, "with -json, report each test as it starts and finishes rather than once its package has")
+	follow        = flag.Bool("follow", false, "for output that's still being written, write each package out as soon as it's done and keep nothing for totals at the end")
+	sortOutput    = flag.Bool("sort", false, "report packages, and the tests in each, in order of their names once all the input has been read, rather than as they finish")
+	showUntested  = flag.Bool("show-untested", false, "report each package without test files as an empty suite, rather than leaving it out")
+	collapse      = flag.Bool("collapse-single", false, "don't put a package or parent test with only the one test in it in a suite of its own")
+	prefix        = flag.String("prefix", "", "put this and a / before the name of every suite and test, e.g. linux/go1.22")
+	trimPrefix    = flag.String("trim-prefix", "", "remove this from the start of package names shown as suites, e.g. your module path")
+	shortNames    = flag.Bool("short-names", false, "name each package's suite for only the last element of its path")
+	groupByDir    = flag.Int("group-by-dir", 0, "put each package's suite in suites for the first this many elements of its path, e.g. services then auth")
+	maxOutput     = flag.Int("max-output-bytes", 0, "attach no more than this much of each test's output to it, 0 for all of it")
+	outputChunk   = flag.Int("output-chunk-bytes", 0, "attach each test's output to it in messages of no more than this much, 0 for all in one")
+	maxLineSize   = flag.Int("max-line-size", defaults.MaxLineSize, "the longest line of input to read, in bytes")
 )
 
-type testResult struct {
-	name        string
-	status      string
-	output      []string
-	durationSec float64
+func main() {
+	flag.Parse()
+	opts := teamcity.Options{
+		StripANSI:             *stripANSI,
+		CapturePass:           *capturePass,
+		CaptureStandardOutput: *captureStdOut,
+		Timestamps:            *timestamps,
+		DurationRounding:      *durationRound,
+		DurationMetadata:      *durationMeta,
+		MaxLineSize:           *maxLineSize,
+		MaxOutputBytes:        *maxOutput,
+		OutputChunkBytes:      *outputChunk,
+		TrimPrefix:            *trimPrefix,
+		ShortNames:            *shortNames,
+		GroupByDir:            *groupByDir,
+		Format:                *format,
+		FailOnSkip:            *failOnSkip,
+		Blocks:                *blocks,
+		Prefix:                *prefix,
+		Flat:                  *flat,
+		CollapseSingle:        *collapse,
+		ShowUntested:          *showUntested,
+		Sort:                  *sortOutput,
+		Realtime:              *realtime,
+		Follow:                *follow,
+		Quiet:                 *quiet,
+		BenchmarkThreshold:    *benchThresh,
+		BenchmarksAsTests:     *benchAsTests,
+		SummaryProblem:        *summary,
+		MaxTestDuration:       time.Duration(*maxDuration) * time.Millisecond,
+		FailSlow:              *failSlow,
+		Strict:                *strict,
+		GoVersion:             *goVersion,
+		Vet:                   *vet,
+	}
+	err := run(opts)
+	if err == teamcity.ErrTestsFailed {
+		// TeamCity has already been told all about it
+		if !*exitZero {
+			os.Exit(1)
+		}
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
-func escape(input string) string {
-	// TC escaping is described here https://confluence.jetbrains.com/display/TCD7/Build+Script+Interaction+with+TeamCity#BuildScriptInteractionwithTeamCity-servMsgsServiceMessages
-	specEscape := func(in string) string {
-		if in == "\n" {
-			return "|n"
-		} else if in == "\r" {
-			return "|r"
-		} else {
-			return "|" + in
-		}
-	}
-	input = specialCharsPattern.ReplaceAllStringFunc(input, specEscape)
-	unicodeEscape := func(in string) string {
-		return fmt.Sprintf("|0x%04x", byte(in[0]))
-	}
-	return nonAsciiCharsPattern.ReplaceAllStringFunc(input, unicodeEscape)
+// The rest of the options come from flags that need checking first
+func run(opts teamcity.Options) error {
+	if *format != teamcity.FormatTeamCity && *format != teamcity.FormatJUnit && *format != teamcity.FormatJSON {
+		return fmt.Errorf("unknown format %q, expected teamcity, junit or json", *format)
+	}
+	if *durationRound != teamcity.RoundNearest && *durationRound != teamcity.RoundDown && *durationRound != teamcity.RoundUp {
+		return fmt.Errorf("unknown -duration-round %q, expected round, truncate or ceil", *durationRound)
+	}
+	if *goVersion != "" && !goVersionPattern.MatchString(*goVersion) {
+		return fmt.Errorf("bad -go-version %q, expected one like 1.22", *goVersion)
+	}
+	if *ginkgoInput && *jsonInput {
+		return fmt.Errorf("-ginkgo and -json can't be used together")
+	}
+	if *ginkgoInput && (*strict || *blocks) {
+		return fmt.Errorf("-strict and -blocks are for go test's own output, so can't be used with -ginkgo")
+	}
+	if *follow && (*format != teamcity.FormatTeamCity || *jsonOutPath != "") {
+		return fmt.Errorf("-follow keeps nothing to write a report from at the end, so can only be used with -format teamcity")
+	}
+	if *sortOutput && (*realtime || *follow) {
+		return fmt.Errorf("-sort waits for all the input before reporting anything, so can't be used with -realtime or -follow")
+	}
+	if *sortOutput && *blocks {
+		return fmt.Errorf("-sort reports each package's suite once all the input has been read, long after its block, so can't be used with -blocks")
+	}
+	if *failSlow && *maxDuration <= 0 {
+		return fmt.Errorf("-fail-slow needs -max-test-duration")
+	}
+	if *realtime && *blocks {
+		return fmt.Errorf("-blocks holds each package's output until it finishes, so can't be used with -realtime")
+	}
+	if *realtime && !*jsonInput {
+		return fmt.Errorf("-realtime needs -json, without it we don't know which package a test is in until it's done")
+	}
+	if *include != "" {
+		pattern, err := regexp.Compile(*include)
+		if err != nil {
+			return fmt.Errorf("bad -include: %v", err)
+		}
+		opts.Include = pattern
+	}
+	if *artifacts != "" {
+		pattern, err := regexp.Compile(*artifacts)
+		if err != nil {
+			return fmt.Errorf("bad -artifacts: %v", err)
+		}
+		opts.ArtifactPattern = pattern
+	}
+	if *messagePat != "" {
+		pattern, err := regexp.Compile(*messagePat)
+		if err != nil {
+			return fmt.Errorf("bad -message-pattern: %v", err)
+		}
+		opts.MessagePattern = pattern
+	}
+	if *exclude != "" {
+		pattern, err := regexp.Compile(*exclude)
+		if err != nil {
+			return fmt.Errorf("bad -exclude: %v", err)
+		}
+		opts.Exclude = pattern
+	}
+	if *mutedPath != "" {
+		muted, err := loadMuted(*mutedPath)
+		if err != nil {
+			return fmt.Errorf("bad -muted: %v", err)
+		}
+		opts.Muted = muted
+	}
+	if *baselinePath != "" {
+		baseline, err := loadReport(*baselinePath)
+		if err != nil {
+			return fmt.Errorf("bad -baseline: %v", err)
+		}
+		opts.Baseline = baseline
+	}
+	if *benchBaseline != "" {
+		baseline, err := loadReport(*benchBaseline)
+		if err != nil {
+			return fmt.Errorf("bad -bench-baseline: %v", err)
+		}
+		opts.BenchmarkBaseline = baseline
+	}
+	// Any files given as arguments are read one after another as though they were one, e.g. the logs of each shard
+	paths := flag.Args()
+	if *inputPath != "" {
+		paths = append([]string{*inputPath}, paths...)
+	}
+	if *fifo && len(paths) == 0 {
+		return fmt.Errorf("-fifo needs the named pipe to read given with -input")
+	}
+	var input io.Reader = os.Stdin
+	if len(paths) == 0 && *gzipInput {
+		reader, err := gzip.NewReader(input)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		input = reader
+	}
+	if len(paths) > 0 {
+		var inputs []io.Reader
+		for _, path := range paths {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			var reader io.Reader = file
+			if *fifo {
+				if info, err := file.Stat(); err != nil {
+					return err
+				} else if info.Mode()&os.ModeNamedPipe == 0 {
+					return fmt.Errorf("-fifo: %s isn't a named pipe", path)
+				}
+				pipe := &pipeReader{path: path, file: file}
+				defer pipe.Close()
+				reader = pipe
+			}
+			if *gzipInput || strings.HasSuffix(path, ".gz") {
+				decompressed, err := gzip.NewReader(reader)
+				if err != nil {
+					return fmt.Errorf("%s: %v", path, err)
+				}
+				defer decompressed.Close()
+				reader = decompressed
+			}
+			// In case one doesn't end in a newline, its last line shouldn't run into the next one's first
+			inputs = append(inputs, reader, strings.NewReader("\n"))
+		}
+		input = io.MultiReader(inputs...)
+	}
+	var output io.Writer = os.Stdout
+	if *outputPath != "" {
+		file, err := os.Create(*outputPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+		if !*follow {
+			// Otherwise whatever's watching the file should see each package as soon as it's written
+			writer := bufio.NewWriter(file)
+			defer writer.Flush()
+			output = writer
+		}
+	}
+	if *jsonOutPath != "" {
+		file, err := os.Create(*jsonOutPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer := bufio.NewWriter(file)
+		defer writer.Flush()
+		opts.JSONReport = writer
+	}
+	if *teePath != "" {
+		file, err := os.Create(*teePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		// Everything we read is copied before we get a chance to parse (and maybe drop) it
+		input = io.TeeReader(input, file)
+	}
+	if *dryRun {
+		tree := teamcity.TreeHandler(output)
+		if *jsonInput {
+			return teamcity.ParseJSON(input, tree, opts)
+		}
+		if *ginkgoInput {
+			return teamcity.ParseGinkgo(input, tree, opts)
+		}
+		return teamcity.Parse(input, tree, opts)
+	}
+	if *jsonInput {
+		return teamcity.ConvertJSON(input, output, opts)
+	}
+	if *ginkgoInput {
+		return teamcity.ConvertGinkgo(input, output, opts)
+	}
+	return teamcity.Convert(input, output, opts)
 }
 
-func (test *testResult) flush() {
-	fmt.Printf("##teamcity[testStarted name='%s' captureStandardOutput='true']\n", escape(test.name))
-	testOutput := strings.Join(test.output, "\n")
-	if len(test.output) > 0 {
-		fmt.Println(testOutput)
-	}
-	if test.status == "PASS" {
-		// There is no testSucceeded message in TC
-	} else if test.status == "FAIL" {
-		// We need a message for TC to properly recognize the failure
-		// So, try to come up with something succinct
-		message := regexp.MustCompile(`(?m)Error:\s+(.+)$`).FindString(testOutput)
-		if len(message) == 0 {
-			message = strings.TrimSpace(strings.Split(testOutput, "\n")[0])
-		}
-		fmt.Printf("##teamcity[testFailed name='%s' message='%s']\n", escape(test.name), escape(message))
-	} else if test.status == "SKIP" {
-		fmt.Printf("##teamcity[testIgnored name='%s']\n", escape(test.name))
-	}
-	fmt.Printf("##teamcity[testFinished name='%s' duration='%d']\n", escape(test.name), int(test.durationSec*1000))
+// Reads a named pipe through one writer after another, as when each step of a build writes its output to it in turn
+// The writer closing it is only the end of that step, so it's opened again, which waits (rather than spinning) until
+// the next opens it too. A writer that doesn't write anything before closing it is taken to be the end of it all
+type pipeReader struct {
+	path string
+	file *os.File
+	// Whether the current writer has written anything yet
+	written bool
 }
 
-func flushPackage(name string, results []*testResult) {
-	fmt.Printf("##teamcity[testSuiteStarted name='%s']\n", escape(name))
-	for _, test := range results {
-		test.flush()
+func (pipe *pipeReader) Read(p []byte) (int, error) {
+	for {
+		n, err := pipe.file.Read(p)
+		if n > 0 {
+			// Whatever the error, it's for the next read to find out about
+			pipe.written = true
+			return n, nil
+		}
+		if err != io.EOF || !pipe.written {
+			return n, err
+		}
+		pipe.file.Close()
+		if pipe.file, err = os.Open(pipe.path); err != nil {
+			return 0, err
+		}
+		pipe.written = false
 	}
-	fmt.Printf("##teamcity[testSuiteFinished name='%s']\n", escape(name))
 }
 
-func findTest(name string, results []*testResult) *testResult {
-	for _, test := range results {
-		if test.name == name {
-			return test
-		}
-	}
-	return nil
+func (pipe *pipeReader) Close() error {
+	return pipe.file.Close()
 }
 
-func main() {
-	scanner := bufio.NewScanner(os.Stdin)
-	// We hold onto the test results for a package until it completes, so we can properly output it as a suite
-	packageTestBuffer := []*testResult{}
-	// We explicitly capture test output only upon failure, otherwise it is passed through immediately.
-	var capturingTest *testResult
-	for scanner.Scan() {
-		input := scanner.Text()
+// A report written by an earlier run with -format json
+func loadReport(path string) (*teamcity.Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &teamcity.Report{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
 
-		if cruftPattern.MatchString(input) {
-			// Some stuff we just want to drop
-		} else if match := testRunPattern.FindStringSubmatch(input); match != nil {
-			capturingTest = nil
-			packageTestBuffer = append(packageTestBuffer, &testResult{name: match[1]})
-		} else if match := testFinishPattern.FindStringSubmatch(input); match != nil {
-			test := findTest(match[2], packageTestBuffer)
-			if test == nil {
-				panic("Run `go test` with -v")
-			}
-			test.durationSec, _ = strconv.ParseFloat(match[3], 32)
-			test.status = match[1]
-			if test.status == "FAIL" {
-				// Failure output proceeds a test failure header
-				capturingTest = test
-			}
-		} else if match := packageFinishPattern.FindStringSubmatch(input); match != nil {
-			capturingTest = nil
-			// Flush package results
-			flushPackage(match[2], packageTestBuffer)
-			packageTestBuffer = []*testResult{}
-		} else if capturingTest != nil {
-			// Capture output to the current test
-			capturingTest.output = append(capturingTest.output, input)
-		} else {
-			// Who knows
-			fmt.Println(input)
+// The tests listed in a file, one per line, as a pattern matching any of their full names
+// A * in a name matches anything, slashes included, and blank lines and those starting with # are left out
+func loadMuted(path string) (*regexp.Regexp, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
+		names = append(names, strings.Replace(regexp.QuoteMeta(line), `\*`, ".*", -1))
+	}
+	if len(names) == 0 {
+		return nil, nil
 	}
+	return regexp.Compile("^(?:" + strings.Join(names, "|") + ")$")
 }
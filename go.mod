@@ -0,0 +1,3 @@
+module github.com/cpfair/go-teamcity-report
+
+go 1.16
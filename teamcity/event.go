@@ -0,0 +1,215 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+package teamcity
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Event is something Parse found in the test output
+// It's one of SuiteStarted, SuiteFinished, TestStarted, Output or TestFinished
+type Event interface {
+	isEvent()
+}
+
+// SuiteStarted is the start of a package, or of the subtests of a test
+type SuiteStarted struct {
+	Name    string
+	Package string
+	Time    time.Time
+}
+
+// SuiteFinished is the end of a package, or of the subtests of a test
+type SuiteFinished struct {
+	Name    string
+	Package string
+	// How long the tests in it took between them, or for the subtests of a test, how long it took
+	Duration time.Duration
+	Time     time.Time
+}
+
+// TestStarted is the start of a test, named for only the last part of its name if it's a subtest
+type TestStarted struct {
+	Name    string
+	Package string
+	// With Options.Realtime, tests (like a parent and its subtests) can be running at the same time, so each gets a flow
+	// of its own within its package's
+	Flow string
+	Time time.Time
+}
+
+// Output is what a test printed, when that was attached to it rather than passed through
+type Output struct {
+	Test    string
+	Package string
+	Flow    string
+	Text    string
+	Stderr  bool // Whether we reckon it went to stderr rather than stdout
+	Time    time.Time
+}
+
+// TestFinished is the end of a test, and how it went
+type TestFinished struct {
+	Name     string
+	Package  string
+	Flow     string
+	Status   string // PASS, FAIL or SKIP
+	Duration time.Duration
+	Message  string // Why it failed or skipped, as best we can tell
+	// What a failing test expected and actually got, if Compared
+	Compared bool
+	Expected string
+	Actual   string
+	// Files the test wrote, going by Options.ArtifactPattern
+	Artifacts []string
+	// How the test went in Options.Baseline, if that was different
+	Baseline string
+	// With Options.MaxTestDuration, how much too long the test took, if it did
+	Slow string
+	Time time.Time
+}
+
+func (SuiteStarted) isEvent()  {}
+func (SuiteFinished) isEvent() {}
+func (TestStarted) isEvent()   {}
+func (Output) isEvent()        {}
+func (TestFinished) isEvent()  {}
+
+// TeamCityHandler returns a Parse handler that writes each event as TeamCity service messages, as opts say to
+// The package doubles as the flowId, so TeamCity can tell apart the messages of packages run in parallel
+func TeamCityHandler(w io.Writer, opts Options) func(Event) {
+	return func(event Event) {
+		switch event := event.(type) {
+		case SuiteStarted:
+			fmt.Fprintf(w, "##teamcity[testSuiteStarted name='%s' flowId='%s'%s]\n", Escape(event.Name), Escape(event.Package), opts.timestamp(event.Time))
+		case SuiteFinished:
+			fmt.Fprintf(w, "##teamcity[testSuiteFinished name='%s' flowId='%s'%s]\n", Escape(event.Name), Escape(event.Package), opts.timestamp(event.Time))
+		case TestStarted:
+			if event.Flow != "" {
+				fmt.Fprintf(w, "##teamcity[flowStarted flowId='%s' parent='%s'%s]\n", Escape(event.Flow), Escape(event.Package), opts.timestamp(event.Time))
+			}
+			fmt.Fprintf(w, "##teamcity[testStarted name='%s' captureStandardOutput='%t' flowId='%s'%s]\n", Escape(event.Name), opts.CaptureStandardOutput, Escape(flowID(event.Package, event.Flow)), opts.timestamp(event.Time))
+		case Output:
+			if event.Stderr {
+				fmt.Fprintf(w, "##teamcity[testStdErr name='%s' out='%s' flowId='%s'%s]\n", Escape(event.Test), Escape(event.Text), Escape(flowID(event.Package, event.Flow)), opts.timestamp(event.Time))
+			} else if opts.CaptureStandardOutput && !opts.Quiet {
+				fmt.Fprintln(w, defang(event.Text))
+			} else {
+				fmt.Fprintf(w, "##teamcity[testStdOut name='%s' out='%s' flowId='%s'%s]\n", Escape(event.Test), Escape(event.Text), Escape(flowID(event.Package, event.Flow)), opts.timestamp(event.Time))
+			}
+		case TestFinished:
+			flow := flowID(event.Package, event.Flow)
+			milliseconds := opts.milliseconds(event.Duration)
+			if opts.DurationMetadata {
+				fmt.Fprintf(w, "##teamcity[testMetadata name='durationMs' type='number' value='%d' flowId='%s'%s]\n", milliseconds, Escape(flow), opts.timestamp(event.Time))
+			}
+			for _, path := range event.Artifacts {
+				fmt.Fprintf(w, "##teamcity[testMetadata type='artifact' value='%s' flowId='%s'%s]\n", Escape(path), Escape(flow), opts.timestamp(event.Time))
+			}
+			if event.Baseline != "" {
+				fmt.Fprintf(w, "##teamcity[testMetadata name='baseline' value='%s' flowId='%s'%s]\n", Escape(event.Baseline+" -> "+event.Status), Escape(flow), opts.timestamp(event.Time))
+			}
+			if event.Slow != "" {
+				fmt.Fprintf(w, "##teamcity[testMetadata name='slow' value='%s' flowId='%s'%s]\n", Escape(event.Slow), Escape(flow), opts.timestamp(event.Time))
+			}
+			if event.Status == "PASS" {
+				// There is no testSucceeded message in TC
+			} else if event.Status == "FAIL" {
+				if event.Compared {
+					// TC shows these as a diff
+					fmt.Fprintf(w, "##teamcity[testFailed type='comparisonFailure' name='%s' message='%s' expected='%s' actual='%s' flowId='%s'%s]\n", Escape(event.Name), Escape(event.Message), Escape(event.Expected), Escape(event.Actual), Escape(flow), opts.timestamp(event.Time))
+				} else {
+					fmt.Fprintf(w, "##teamcity[testFailed name='%s' message='%s' flowId='%s'%s]\n", Escape(event.Name), Escape(event.Message), Escape(flow), opts.timestamp(event.Time))
+				}
+			} else if event.Status == "SKIP" {
+				fmt.Fprintf(w, "##teamcity[testIgnored name='%s' message='%s' flowId='%s'%s]\n", Escape(event.Name), Escape(event.Message), Escape(flow), opts.timestamp(event.Time))
+			}
+			fmt.Fprintf(w, "##teamcity[testFinished name='%s' duration='%d' flowId='%s'%s]\n", Escape(event.Name), milliseconds, Escape(flow), opts.timestamp(event.Time))
+			if event.Flow != "" {
+				fmt.Fprintf(w, "##teamcity[flowFinished flowId='%s'%s]\n", Escape(event.Flow), opts.timestamp(event.Time))
+			}
+		}
+	}
+}
+
+// TreeHandler returns a Parse handler that writes a plain outline of the suites and tests, for seeing what was made of
+// the input without picking through service messages
+func TreeHandler(w io.Writer) func(Event) {
+	depth := 0
+	// What each test has had attached to it so far, by package and name
+	outputBytes := map[[2]string]int{}
+	return func(event Event) {
+		indent := strings.Repeat("  ", depth)
+		switch event := event.(type) {
+		case SuiteStarted:
+			fmt.Fprintf(w, "%s%s\n", indent, event.Name)
+			depth++
+		case SuiteFinished:
+			depth--
+		case Output:
+			outputBytes[[2]string{event.Package, event.Test}] += len(event.Text)
+		case TestFinished:
+			key := [2]string{event.Package, event.Name}
+			details := fmt.Sprintf("%.2fs", event.Duration.Seconds())
+			if outputBytes[key] > 0 {
+				details += fmt.Sprintf(", %d bytes of output", outputBytes[key])
+			}
+			delete(outputBytes, key)
+			fmt.Fprintf(w, "%s%s %s (%s)", indent, event.Status, event.Name, details)
+			if event.Message != "" {
+				fmt.Fprintf(w, ": %s", strings.SplitN(event.Message, "\n", 2)[0])
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// With Sort, handle gets every package's events only once all the input has been read, by package name, for the
+// same order whatever order they finished in. The returned func hands them over, and without Sort does nothing
+func (opts Options) sortEvents(handle func(Event)) (func(Event), func()) {
+	if !opts.Sort {
+		return handle, func() {}
+	}
+	packages := map[string][]Event{}
+	hold := func(event Event) {
+		pkg := ""
+		switch event := event.(type) {
+		case SuiteStarted:
+			pkg = event.Package
+		case SuiteFinished:
+			pkg = event.Package
+		case TestStarted:
+			pkg = event.Package
+		case Output:
+			pkg = event.Package
+		case TestFinished:
+			pkg = event.Package
+		}
+		packages[pkg] = append(packages[pkg], event)
+	}
+	release := func() {
+		var names []string
+		for pkg := range packages {
+			names = append(names, pkg)
+		}
+		sort.Strings(names)
+		for _, pkg := range names {
+			for _, event := range packages[pkg] {
+				handle(event)
+			}
+		}
+		packages = map[string][]Event{}
+	}
+	return hold, release
+}
+
+func flowID(pkg string, flow string) string {
+	if flow != "" {
+		return flow
+	}
+	return pkg
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+package teamcity
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ginkgoSuitePattern     = regexp.MustCompile(`^Running Suite: (.*?)(?: - \S.*)?$`)
+	ginkgoDelimiterPattern = regexp.MustCompile(`^-{30}$`)
+	// e.g. "• [0.001 seconds]", "• [FAILED] [0.001 seconds]", "S [SKIPPED] [0.000 seconds]" or just "P [PENDING]"
+	ginkgoStatusPattern = regexp.MustCompile(`^([•SP])(?: \[([A-Z ]+)\])?(?: \[([\d.]+) seconds\])?$`)
+	// Ginkgo's own summary of the suite, which is the end of it
+	ginkgoFinishPattern = regexp.MustCompile(`^Ran \d+ of \d+ Specs? in ([\d.]+) seconds`)
+	// Where the details of a failure (or skip) end, and which node it was in
+	ginkgoLocationPattern = regexp.MustCompile(`^\s*In \[\w+\] at: `)
+	ginkgoMessagePattern  = regexp.MustCompile(`^\s*\[[A-Z ]+\] (.*)$`)
+)
+
+// ConvertGinkgo reads the output of Ginkgo specs, run with -ginkgo.v (or `ginkgo -v`), and writes it back out as
+// TeamCity service messages, or whatever opts.Format says
+// Each of Ginkgo's suites is a suite, with a suite for each container (Describe, Context...) and a test for each spec
+// The containers are told apart by Ginkgo's colours, so without them (-ginkgo.no-color) the specs aren't nested
+// Neither Strict nor Blocks apply, there's no telling what Ginkgo might print between its specs, nor which package
+// is running until its suite starts
+func ConvertGinkgo(r io.Reader, output io.Writer, opts Options) error {
+	w := opts.messageWriter(output)
+	report, failed, err := convertGinkgo(r, w, TeamCityHandler(w, opts), opts)
+	return opts.finishConversion(output, report, failed, err)
+}
+
+// ParseGinkgo reads the output of Ginkgo specs, calling handler with each suite and spec it finds
+func ParseGinkgo(r io.Reader, handler func(Event), opts Options) error {
+	_, _, err := convertGinkgo(r, io.Discard, handler, opts)
+	return err
+}
+
+func convertGinkgo(r io.Reader, w io.Writer, handle func(Event), opts Options) (*Report, bool, error) {
+	scanner := opts.newScanner(r)
+	handle, flushSorted := opts.sortEvents(handle)
+	// The suite currently running, and its specs so far
+	suite := ""
+	var specs []*TestResult
+	// The lines of the spec currently being reported, between delimiters, nil when there isn't one
+	var block []string
+	counts := testCounts{}
+	report := &Report{}
+	// Whether anything at all failed
+	failed := false
+	// Whether the last suite had muted failures, which would be why its package failed
+	muted := false
+	flush := func(duration float64) {
+		if len(specs) == 0 {
+			return
+		}
+		opts.flushPackage(handle, suite, specs)
+		counts.add(suite, specs, opts)
+		report.add(suite, duration, specs, nil, opts)
+		reportPackageDuration(w, suite, duration)
+		if opts.anyFailed(specs) {
+			failed = true
+		}
+		muted = opts.anyMuted(specs)
+		specs = nil
+	}
+	for scanner.Scan() {
+		// The colours are how Ginkgo tells apart a spec's containers, so the lines of a spec are kept as they are
+		raw := scanner.Text()
+		plain := ansiPattern.ReplaceAllString(raw, "")
+		text := plain
+		if !opts.StripANSI {
+			text = raw
+		}
+
+		if ginkgoDelimiterPattern.MatchString(plain) {
+			if block != nil {
+				if spec := parseGinkgoSpec(block); spec != nil {
+					// Same as go test's, a spec's output is only attached to it if it failed, or with CapturePass
+					spec.release(w, opts)
+					specs = append(specs, spec)
+				} else {
+					// Something other than a spec, like a failing BeforeSuite
+					printLines(w, stripLines(block))
+				}
+			}
+			block = []string{}
+		} else if block != nil && !ginkgoFinishPattern.MatchString(plain) && !strings.HasPrefix(plain, "Summarizing ") {
+			block = append(block, raw)
+		} else if match := ginkgoSuitePattern.FindStringSubmatch(plain); match != nil {
+			flush(0)
+			suite = match[1]
+			fmt.Fprintln(w, defang(text))
+		} else if match := ginkgoFinishPattern.FindStringSubmatch(plain); match != nil {
+			// The last spec isn't followed by another delimiter
+			block = nil
+			duration, _ := strconv.ParseFloat(match[1], 64)
+			flush(duration)
+			fmt.Fprintln(w, defang(text))
+		} else if strings.HasPrefix(plain, "Summarizing ") {
+			// Ginkgo repeats the failures once it's done, which they've already been reported as
+			block = nil
+			fmt.Fprintln(w, defang(text))
+		} else if match := buildFailedPattern.FindStringSubmatch(plain); match != nil {
+			failed = true
+			reportBuildFailure(w, match[1], nil)
+			fmt.Fprintln(w, defang(text))
+		} else if match := matchPackageFinish(plain); match != nil && match[1] == "FAIL" {
+			// Ginkgo may have failed outside of any spec
+			if !muted {
+				failed = true
+			}
+			fmt.Fprintln(w, defang(text))
+		} else if framingPattern.MatchString(plain) || cruftPattern.MatchString(plain) {
+			// The Go test that runs the suite, which is reported by the specs instead
+		} else {
+			fmt.Fprintln(w, defang(text))
+		}
+	}
+	// Without its summary, the output ended partway through the suite
+	failUnfinished(specs, incompleteMessage)
+	flush(0)
+	flushSorted()
+	if !opts.Follow {
+		counts.report(w)
+	}
+	if opts.SummaryProblem {
+		counts.reportProblem(w)
+	}
+	counts.reportSlow(w, opts)
+	return report, failed, opts.scanError(scanner)
+}
+
+// The lines of a single spec's report, from between two delimiters
+// With -ginkgo.v that's its name and location, its output and then its status, followed on failure by its name,
+// location and the details of the failure again. Without, only failures are reported, starting with the status
+func parseGinkgoSpec(block []string) *TestResult {
+	status := -1
+	var match []string
+	for i, line := range block {
+		if match = ginkgoStatusPattern.FindStringSubmatch(ansiPattern.ReplaceAllString(line, "")); match != nil {
+			status = i
+			break
+		}
+	}
+	if status == -1 {
+		return nil
+	}
+	name := ""
+	var output, details []string
+	if status > 0 {
+		name = block[0]
+		if status > 2 {
+			output = stripLines(block[2:status])
+		}
+	} else if len(block) > 1 {
+		name = block[1]
+	}
+	if ginkgoSpecName(name) == "" {
+		// Without -ginkgo.v, the dots for the specs that passed are all there is of them
+		return nil
+	}
+	if rest := block[status+1:]; len(rest) >= 2 {
+		// The name is repeated on its own line (if it was already given), followed by the location
+		details = stripLines(rest[2:])
+		for len(details) > 0 && strings.TrimSpace(details[0]) == "" {
+			details = details[1:]
+		}
+	}
+	spec := &TestResult{Name: ginkgoSpecName(name), Finished: time.Now()}
+	if seconds, err := strconv.ParseFloat(match[3], 64); err == nil {
+		spec.DurationSec = seconds
+		spec.Started = spec.Finished.Add(-time.Duration(seconds * float64(time.Second)))
+	}
+	switch {
+	case match[1] == "S":
+		spec.Status = "SKIP"
+	case match[1] == "P":
+		spec.Status = "SKIP"
+		spec.Message = "pending"
+	case match[2] == "" || match[2] == "SLOW TEST":
+		spec.Status = "PASS"
+	default:
+		// FAILED, PANICKED, TIMEDOUT, INTERRUPTED...
+		spec.Status = "FAIL"
+	}
+	if message := ginkgoMessage(details); message != "" {
+		spec.Message = message
+	}
+	for _, line := range output {
+		spec.appendOutput(line, false)
+	}
+	for _, line := range details {
+		spec.appendOutput(line, true)
+	}
+	return spec
+}
+
+// A spec's name is its containers' then its own, which Ginkgo writes on one line in alternating colours
+// They're joined with slashes like subtests, so a slash in one of them is taken for another level of nesting
+// With -ginkgo.no-color there's nothing to tell them apart by, and each spec is a test named for all of it, in the
+// suite's own suite
+func ginkgoSpecName(line string) string {
+	var parts []string
+	for _, part := range ansiPattern.Split(line, -1) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, strings.TrimPrefix(part, "[It] "))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// The details of a failure end with what went wrong, then where
+func ginkgoMessage(details []string) string {
+	var message []string
+	for _, line := range details {
+		if ginkgoLocationPattern.MatchString(line) {
+			break
+		}
+		// The timeline of what happened can come first, with the same markers
+		if match := ginkgoMessagePattern.FindStringSubmatch(line); match != nil {
+			message = []string{match[1]}
+		} else if message != nil {
+			message = append(message, strings.TrimSpace(line))
+		}
+	}
+	return strings.TrimSpace(strings.Join(message, "\n"))
+}
+
+func stripLines(lines []string) []string {
+	stripped := make([]string, len(lines))
+	for i, line := range lines {
+		stripped[i] = ansiPattern.ReplaceAllString(line, "")
+	}
+	return stripped
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+package teamcity
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConvertGinkgo(t *testing.T) {
+	checkGolden(t, "ginkgo", ConvertGinkgo, ErrTestsFailed)
+}
+
+// Each container is a suite, told apart by Ginkgo's colours, and like go test's, only a failure's output is attached
+func TestParseGinkgo(t *testing.T) {
+	checkOutline(t, outline(t, ParseGinkgo, testdata(t, "ginkgo.txt"), DefaultOptions()), `Books Suite
+  Books
+    with lots of pages
+      PASS is a novel (0.00s)
+      FAIL fails (0.00s, 233 bytes of output): Expected
+    SKIP is skipped (0.00s): not today
+    SKIP is pending (0.00s): pending
+    FAIL panics (0.00s, 258 bytes of output): Test Panicked
+`)
+	opts := DefaultOptions()
+	opts.CapturePass = true
+	if got := outline(t, ParseGinkgo, testdata(t, "ginkgo.txt"), opts); !strings.Contains(got, "PASS is a novel (0.00s, 19 bytes of output)") {
+		t.Errorf("with CapturePass, the passing spec's output isn't attached:\n%s", got)
+	}
+}
+
+// Without colours, the specs can't be nested in their containers, but are still all there under their full names
+func TestParseGinkgoWithoutColour(t *testing.T) {
+	checkOutline(t, outline(t, ParseGinkgo, testdata(t, "ginkgonocolor.txt"), DefaultOptions()), `Books Suite
+  PASS Books with lots of pages is a novel (0.00s)
+  FAIL Books with lots of pages fails (0.00s, 231 bytes of output): Expected
+  SKIP Books is skipped (0.00s): not today
+  SKIP Books is pending (0.00s): pending
+  FAIL Books panics (0.00s, 256 bytes of output): Test Panicked
+`)
+}
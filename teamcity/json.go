@@ -0,0 +1,398 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+package teamcity
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TestEvent is a single line of `go test -json` output, see `go doc test2json`
+type TestEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string
+	Output  string
+	Elapsed float64
+	// Only for compiler output, from Go 1.24 on
+	ImportPath  string
+	FailedBuild string
+	// From Go 1.25 on, output from t.Error and friends is marked as "error"
+	OutputType string
+}
+
+// ConvertJSON reads the output of `go test -json` and writes it back out as TeamCity service messages, or whatever opts.Format says
+func ConvertJSON(r io.Reader, output io.Writer, opts Options) error {
+	w := opts.messageWriter(output)
+	report, failed, err := convertJSON(r, w, TeamCityHandler(w, opts), opts)
+	return opts.finishConversion(output, report, failed, err)
+}
+
+// ParseJSON reads the output of `go test -json`, calling handler with each suite and test it finds
+// Anything else in the input, like build failures and benchmarks, is dropped
+func ParseJSON(r io.Reader, handler func(Event), opts Options) error {
+	_, _, err := convertJSON(r, io.Discard, handler, opts)
+	return err
+}
+
+// Anything we write ourselves goes to w, whereas the suites and tests go to handle
+func convertJSON(r io.Reader, w io.Writer, handle func(Event), opts Options) (*Report, bool, error) {
+	scanner := opts.newScanner(r)
+	handle, flushSorted := opts.sortEvents(handle)
+	// Packages may run concurrently, so each gets its own buffer
+	packageTestBuffers := map[string][]*TestResult{}
+	// Compiler output by the import path being built
+	// Before Go 1.24 this came as plain text on stderr, which ends up under ""
+	diagnostics := map[string][]string{}
+	failedBuilds := map[string]bool{}
+	// Benchmark results are written in pieces, so output that doesn't end in a newline needs to wait for the rest
+	type outputKey struct{ pkg, test string }
+	partialOutput := map[outputKey]string{}
+	coverage := coverageStats{}
+	// Each package's coverage, from the line of its own before its finish line, which only repeats it if it passed
+	packageCoverage := map[string]string{}
+	inspections := inspections{}
+	blocks := map[string]*packageBlock{}
+	// Output from before each package's first test
+	setupOutput := map[string][]string{}
+	// And from outside of any test since, in case it's why the package failed
+	trailingOutput := map[string][]string{}
+	// The benchmarks we've seen run, to tell their names apart from the GOMAXPROCS suffix on their results
+	benchmarks := map[string]bool{}
+	// And the GOMAXPROCS of each one's first result, see reportBenchmark
+	benchmarkProcs := map[string]string{}
+	// And their results, by package
+	benchmarkResults := map[string][]Benchmark{}
+	names := packageNames{}
+	// With opts.Realtime, the packages whose suites have been started, and the names they were started under
+	streaming := map[string]string{}
+	counts := testCounts{}
+	// The summary that ends the output, if whatever ran the tests wrote one
+	summary := ""
+	report := &Report{}
+	// Lines we have no idea about, for opts.Strict
+	unrecognized := &UnrecognizedError{strict: opts.Strict}
+	// Whether anything at all failed
+	failed := false
+	// A benchmark's result, wherever test2json put it
+	benchmarkResult := func(pw io.Writer, event TestEvent, match []string) {
+		benchmark := reportBenchmark(pw, match, benchmarks, benchmarkProcs)
+		benchmarkResults[event.Package] = append(benchmarkResults[event.Package], benchmark)
+		if test := passBenchmark(pw, packageTestBuffers[event.Package], benchmark, event.Time, opts); test != nil && test.streamed {
+			test.finish(handle, opts.prefixed(test.Name), streaming[event.Package], opts)
+		}
+	}
+	for scanner.Scan() {
+		var event TestEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// Not from test2json, so pass it along as-is
+			if opts.Vet {
+				inspections.report(w, scanner.Text())
+			}
+			if diagnosticPattern.MatchString(scanner.Text()) || (opts.Vet && vetPattern.MatchString(scanner.Text())) {
+				diagnostics[""] = append(diagnostics[""], scanner.Text())
+			} else if testSummaryPattern.MatchString(scanner.Text()) {
+				summary = scanner.Text()
+			} else {
+				unrecognized.add(scanner.Text())
+			}
+			fmt.Fprintln(w, defang(scanner.Text()))
+			continue
+		}
+		if event.Action == "output" {
+			key := outputKey{event.Package, event.Test}
+			if !strings.HasSuffix(event.Output, "\n") {
+				partialOutput[key] += event.Output
+				continue
+			}
+			event.Output = partialOutput[key] + event.Output
+			delete(partialOutput, key)
+		}
+		// Output from Windows can end in \r\n, even though test2json's own lines don't
+		text := strings.TrimSuffix(strings.TrimSuffix(event.Output, "\n"), "\r")
+		if opts.StripANSI {
+			text = ansiPattern.ReplaceAllString(text, "")
+		}
+
+		if event.Action == "build-output" {
+			if opts.Vet {
+				inspections.report(w, text)
+			}
+			diagnostics[event.ImportPath] = append(diagnostics[event.ImportPath], text)
+			fmt.Fprintln(w, defang(text))
+			continue
+		}
+
+		// Everything else is about a particular package, so goes in its block
+		pw := blocks[event.Package]
+		if pw == nil {
+			pw = &packageBlock{w: w, blocks: opts.Blocks}
+			blocks[event.Package] = pw
+		}
+
+		if event.Test == "" {
+			// Package-level events
+			switch event.Action {
+			case "pass", "fail", "skip":
+				passBenchmarks(packageTestBuffers[event.Package])
+				packageTestBuffers[event.Package] = opts.reportedBenchmarks(packageTestBuffers[event.Package])
+				if (event.Action == "fail" && !opts.anyMuted(packageTestBuffers[event.Package])) || opts.anyFailed(packageTestBuffers[event.Package]) {
+					failed = true
+				}
+				pkg, streamed := streaming[event.Package]
+				if !streamed {
+					pkg = names.unique(event.Package)
+				}
+				// Same as the text format, a package without test files gets no block unless there's more to it
+				untested := event.Action == "skip" && event.FailedBuild == "" && !failedBuilds[event.Package] &&
+					len(packageTestBuffers[event.Package]) == 0 && onlyUntested(setupOutput[event.Package]) && pw.empty()
+				if !untested || opts.ShowUntested {
+					pw.open(pkg)
+				}
+				if event.FailedBuild != "" || failedBuilds[event.Package] {
+					unrecognized.addLines(setupOutput[event.Package])
+					unrecognized.addLines(trailingOutput[event.Package])
+					printLines(pw, setupOutput[event.Package])
+					printLines(pw, trailingOutput[event.Package])
+					reportBuildFailure(pw, pkg, diagnostics[event.FailedBuild])
+					report.addBuildFailure(pkg, diagnostics[event.FailedBuild])
+					delete(diagnostics, event.FailedBuild)
+					delete(failedBuilds, event.Package)
+				} else if event.Action == "skip" {
+					// A skipped package is one with [no test files], so there's nothing to report
+					unrecognized.addLines(setupOutput[event.Package])
+					printLines(pw, setupOutput[event.Package])
+					if opts.ShowUntested {
+						opts.reportUntested(handle, pkg)
+					}
+				} else {
+					if event.Action == "fail" {
+						output := append(setupOutput[event.Package], trailingOutput[event.Package]...)
+						if test := opts.packageFailure(packageTestBuffers[event.Package], output); test != nil {
+							packageTestBuffers[event.Package] = append(packageTestBuffers[event.Package], test)
+							delete(setupOutput, event.Package)
+							delete(trailingOutput, event.Package)
+						}
+					}
+					if !streamed {
+						reportSetupOutput(pw, pkg, setupOutput[event.Package])
+					}
+					unrecognized.addLines(trailingOutput[event.Package])
+					printLines(pw, trailingOutput[event.Package])
+					if streamed {
+						opts.finishStreamed(handle, pkg, packageTestBuffers[event.Package], event.Time)
+					} else {
+						opts.flushPackage(handle, pkg, packageTestBuffers[event.Package])
+					}
+					counts.add(pkg, packageTestBuffers[event.Package], opts)
+					report.add(pkg, event.Elapsed, packageTestBuffers[event.Package], benchmarkResults[event.Package], opts)
+					if opts.compareBenchmarks(pw, pkg, benchmarkResults[event.Package]) {
+						failed = true
+					}
+					reportPackageDuration(pw, event.Package, event.Elapsed)
+				}
+				if !untested || opts.ShowUntested {
+					pw.close(pkg)
+				}
+				delete(streaming, event.Package)
+				delete(packageTestBuffers, event.Package)
+				delete(blocks, event.Package)
+				delete(setupOutput, event.Package)
+				delete(trailingOutput, event.Package)
+				delete(benchmarkResults, event.Package)
+			case "output":
+				if buildFailedPattern.MatchString(text) {
+					failedBuilds[event.Package] = true
+				}
+				if panicPattern.MatchString(text) {
+					reportBuildProblem(pw, event.Package, text)
+				}
+				if match := matchPackageFinish(text); match != nil {
+					if isCached(match[3]) {
+						reportCached(pw, event.Package)
+					}
+					if noTestsRun(match[3]) {
+						reportNoTestsRun(pw, event.Package)
+					}
+					if line, ok := packageCoverage[event.Package]; ok {
+						coverage.report(pw, event.Package, line)
+					} else {
+						coverage.report(pw, event.Package, match[3])
+					}
+					delete(packageCoverage, event.Package)
+				} else if untestedPackagePattern.MatchString(text) {
+					coverage.report(pw, event.Package, text)
+					fmt.Fprintln(pw, defang(text))
+				} else if match := benchmarkPattern.FindStringSubmatch(text); match != nil {
+					// test2json loses track of which benchmark the results for any -cpu after the first belong to
+					benchmarkResult(pw, event, match)
+					fmt.Fprintln(pw, defang(text))
+				} else if coveragePattern.MatchString(text) {
+					packageCoverage[event.Package] = text
+					fmt.Fprintln(pw, defang(text))
+				} else if benchmarkInfoPattern.MatchString(text) {
+					// Only what the benchmarks ran on, not why the package failed, nor its setup
+					fmt.Fprintln(pw, defang(text))
+				} else if cruftPattern.MatchString(text) {
+					// Some stuff we just want to drop
+				} else if len(packageTestBuffers[event.Package]) == 0 {
+					// Only unrecognised if it isn't reported as the package's setup or TestMain's output in the end
+					setupOutput[event.Package] = append(setupOutput[event.Package], text)
+				} else {
+					trailingOutput[event.Package] = append(trailingOutput[event.Package], text)
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(event.Test, "Benchmark") {
+			benchmarks[event.Test] = true
+			if match := benchmarkPattern.FindStringSubmatch(text); match != nil && event.Action == "output" {
+				benchmarkResult(pw, event, match)
+				fmt.Fprintln(pw, defang(text))
+				continue
+			}
+			if event.Action == "output" && text == event.Test {
+				// Its name, as it starts
+				fmt.Fprintln(pw, defang(text))
+				continue
+			}
+			// Otherwise they're tests like any other, but for how they pass, and that without BenchmarksAsTests only
+			// those that fail or skip are reported
+		}
+
+		test := findTest(event.Test, packageTestBuffers[event.Package])
+		if test == nil || event.Action == "run" {
+			test = &TestResult{Name: event.Test, Started: event.Time}
+			packageTestBuffers[event.Package] = append(packageTestBuffers[event.Package], test)
+		}
+		switch event.Action {
+		case "run":
+			// Without BenchmarksAsTests, a benchmark is only reported if it fails, so it can't be said to start
+			if !opts.Realtime || len(opts.filterTests([]*TestResult{test})) == 0 ||
+				(strings.HasPrefix(test.Name, "Benchmark") && !opts.BenchmarksAsTests) {
+				break
+			}
+			if _, ok := streaming[event.Package]; !ok {
+				// The package's suite starts along with its first test, with whatever it printed before that first
+				streaming[event.Package] = names.unique(event.Package)
+				reportSetupOutput(pw, streaming[event.Package], setupOutput[event.Package])
+				delete(setupOutput, event.Package)
+				opts.openGroups(handle, streaming[event.Package], event.Time)
+				handle(SuiteStarted{Name: opts.suiteName(streaming[event.Package]), Package: streaming[event.Package], Time: event.Time})
+			}
+			test.streamed = true
+			test.start(handle, opts.prefixed(test.Name), streaming[event.Package])
+		case "output":
+			if panicPattern.MatchString(text) && !test.panicked {
+				test.Message = text
+				test.panicked = true
+				if timeoutPattern.MatchString(text) {
+					failUnfinished(packageTestBuffers[event.Package], text)
+				}
+			}
+			if raceWarningPattern.MatchString(text) {
+				test.raced = true
+				if test.Message == "" {
+					test.Message = dataRaceMessage
+				}
+			}
+			if !framingPattern.MatchString(text) {
+				test.appendOutput(text, strings.HasPrefix(event.OutputType, "error"))
+			}
+		case "pass", "fail", "skip":
+			test.Status = strings.ToUpper(event.Action)
+			test.failIfRaced()
+			test.DurationSec = event.Elapsed
+			if event.Elapsed == 0 && strings.HasPrefix(test.Name, "Benchmark") && !test.Started.IsZero() {
+				// A benchmark's fail or skip doesn't say how long it took, but it's been running since it started
+				test.DurationSec = event.Time.Sub(test.Started).Seconds()
+			}
+			test.Finished = event.Time
+			test.addToParent(packageTestBuffers[event.Package])
+			// Same as the text format, only failure output is attached to the test
+			test.release(pw, opts)
+			if test.streamed {
+				test.finish(handle, opts.prefixed(test.Name), streaming[event.Package], opts)
+			}
+		}
+	}
+	// Output that never got the rest of its line, as when the run was killed partway through a benchmark, is written
+	// as it is rather than lost, in a predictable order
+	var partial []outputKey
+	for key := range partialOutput {
+		partial = append(partial, key)
+	}
+	sort.Slice(partial, func(i, j int) bool {
+		if partial[i].pkg != partial[j].pkg {
+			return partial[i].pkg < partial[j].pkg
+		}
+		return partial[i].test < partial[j].test
+	})
+	for _, key := range partial {
+		text := strings.TrimSuffix(partialOutput[key], "\r")
+		if opts.StripANSI {
+			text = ansiPattern.ReplaceAllString(text, "")
+		}
+		if test := findTest(key.test, packageTestBuffers[key.pkg]); key.test != "" && test != nil && test.Status == "" {
+			// It's reported along with the test, which never finished either
+			test.appendOutput(text, false)
+		} else if _, unfinished := blocks[key.pkg]; unfinished && len(packageTestBuffers[key.pkg]) == 0 {
+			setupOutput[key.pkg] = append(setupOutput[key.pkg], text)
+		} else if unfinished {
+			trailingOutput[key.pkg] = append(trailingOutput[key.pkg], text)
+		} else {
+			fmt.Fprintln(w, defang(text))
+		}
+	}
+	// Any packages that never finished, in a predictable order
+	var unfinished []string
+	for pkg := range blocks {
+		unfinished = append(unfinished, pkg)
+	}
+	sort.Strings(unfinished)
+	for _, pkg := range unfinished {
+		if len(packageTestBuffers[pkg]) == 0 && len(setupOutput[pkg]) == 0 && blocks[pkg].empty() {
+			continue
+		}
+		blocks[pkg].open(pkg)
+		unrecognized.addLines(setupOutput[pkg])
+		unrecognized.addLines(trailingOutput[pkg])
+		printLines(blocks[pkg], setupOutput[pkg])
+		printLines(blocks[pkg], trailingOutput[pkg])
+		if name, streamed := streaming[pkg]; streamed {
+			failUnfinished(packageTestBuffers[pkg], incompleteMessage)
+			opts.finishStreamed(handle, name, packageTestBuffers[pkg], time.Time{})
+		} else {
+			opts.flushIncomplete(handle, pkg, packageTestBuffers[pkg])
+		}
+		blocks[pkg].close(pkg)
+		counts.add(pkg, packageTestBuffers[pkg], opts)
+		if len(packageTestBuffers[pkg]) > 0 {
+			report.add(pkg, 0, packageTestBuffers[pkg], benchmarkResults[pkg], opts)
+		}
+		if opts.anyFailed(packageTestBuffers[pkg]) {
+			failed = true
+		}
+	}
+	flushSorted()
+	if !opts.Follow {
+		coverage.reportAverage(w)
+		counts.report(w)
+	}
+	if opts.SummaryProblem {
+		counts.reportProblem(w)
+	}
+	counts.reportSlow(w, opts)
+	counts.check(os.Stderr, summary)
+	if err := opts.scanError(scanner); err != nil {
+		return report, failed, err
+	}
+	return report, failed, unrecognized.err()
+}
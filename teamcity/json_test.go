@@ -0,0 +1,45 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+package teamcity
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestConvertJSON(t *testing.T) {
+	checkGolden(t, "json", ConvertJSON, ErrTestsFailed)
+}
+
+// With Realtime, a test is reported as started as soon as it is, before any more of the input has been read
+func TestParseJSONRealtime(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Realtime = true
+	r, w := io.Pipe()
+	started := make(chan string, 1)
+	done := make(chan error)
+	go func() {
+		done <- ParseJSON(r, func(event Event) {
+			if event, ok := event.(TestStarted); ok {
+				started <- event.Name
+			}
+		}, opts)
+	}()
+	fmt.Fprintln(w, `{"Action":"run","Package":"ex","Test":"TestA"}`)
+	select {
+	case name := <-started:
+		if name != "TestA" {
+			t.Errorf("got %s started, want TestA", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestA wasn't reported as started while the rest of the input was yet to come")
+	}
+	fmt.Fprintln(w, `{"Action":"pass","Package":"ex","Test":"TestA"}`)
+	fmt.Fprintln(w, `{"Action":"pass","Package":"ex"}`)
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+package teamcity
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The subset of JUnit's XML that tools generally agree on
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message  string `xml:"message,attr"`
+	Contents string `xml:",chardata"`
+}
+
+// WriteJUnit writes a report as JUnit XML
+// Each package is a testsuite, with every test (subtests included, by their full name) a testcase in it
+func WriteJUnit(w io.Writer, report *Report) error {
+	suites := junitTestSuites{}
+	for _, pkg := range report.Packages {
+		suite := junitTestSuite{Name: pkg.Name}
+		if pkg.BuildFailed {
+			// There are no tests to speak of, so the build itself stands in for them
+			suite.Tests = 1
+			suite.Errors = 1
+			suite.Time = junitDuration(0)
+			message := pkg.Name + " failed to build"
+			suite.Cases = append(suite.Cases, junitTestCase{
+				Name:      "[build failed]",
+				Classname: pkg.Name,
+				Time:      junitDuration(0),
+				Error:     &junitMessage{Message: message, Contents: strings.Join(pkg.Diagnostics, "\n")},
+			})
+			suites.Suites = append(suites.Suites, suite)
+			continue
+		}
+		for _, test := range pkg.Tests {
+			testCase := junitTestCase{Name: test.Name, Classname: pkg.Name, Time: junitDuration(test.Duration)}
+			output := strings.Join(append(append([]string{}, test.Output...), test.ErrorOutput...), "\n")
+			switch test.Status {
+			case "FAIL":
+				suite.Failures++
+				testCase.Failure = &junitMessage{Message: test.Message, Contents: output}
+			case "SKIP":
+				suite.Skipped++
+				testCase.Skipped = &junitMessage{Message: test.Message, Contents: output}
+			default:
+				testCase.SystemOut = output
+			}
+			suite.Tests++
+			suite.Cases = append(suite.Cases, testCase)
+		}
+		suite.Time = junitDuration(pkg.Duration)
+		suites.Suites = append(suites.Suites, suite)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "\t")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func junitDuration(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
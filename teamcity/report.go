@@ -0,0 +1,146 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+package teamcity
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// Report is the results of every package, for formats that can only be written once everything is known
+type Report struct {
+	Packages []Package
+	// Tests by package and then name, for looking them up in a baseline
+	index map[string]map[string]*Test
+}
+
+// Package is the results of a single package
+type Package struct {
+	Name     string
+	Duration float64 // In seconds
+	Tests    []Test
+	// Every benchmark result, more than one for the same benchmark with -count or -cpu
+	Benchmarks []Benchmark `json:",omitempty"`
+	// Whether it failed to build, in which case there are no tests and Diagnostics says why
+	BuildFailed bool     `json:",omitempty"`
+	Diagnostics []string `json:",omitempty"`
+}
+
+// Test is the result of a single test, subtests included, by their full name
+type Test struct {
+	Name        string
+	Status      string  // PASS, FAIL or SKIP, as reported
+	Duration    float64 // In seconds
+	Message     string  `json:",omitempty"` // Why it failed or skipped
+	Output      []string
+	ErrorOutput []string `json:",omitempty"`
+}
+
+// Benchmark is the result of a single run of a benchmark
+type Benchmark struct {
+	Name       string
+	Iterations int
+	// By unit, e.g. ns/op or allocs/op
+	Metrics map[string]float64
+}
+
+// MarshalJSON writes the report out with empty lists as such, rather than null, for the sake of whatever reads it
+func (report Report) MarshalJSON() ([]byte, error) {
+	type plainReport Report
+	plain := plainReport{Packages: []Package{}}
+	for _, pkg := range report.Packages {
+		if pkg.Tests == nil {
+			pkg.Tests = []Test{}
+		}
+		tests := make([]Test, len(pkg.Tests))
+		for i, test := range pkg.Tests {
+			if test.Output == nil {
+				test.Output = []string{}
+			}
+			tests[i] = test
+		}
+		pkg.Tests = tests
+		plain.Packages = append(plain.Packages, pkg)
+	}
+	return json.Marshal(plain)
+}
+
+// WriteJSON writes a report as indented JSON
+func WriteJSON(w io.Writer, report *Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(report)
+}
+
+// The test by that name in that package, if there is one
+func (report *Report) findTest(pkg string, name string) *Test {
+	if report.index == nil {
+		report.index = map[string]map[string]*Test{}
+		for i := range report.Packages {
+			tests := map[string]*Test{}
+			for j := range report.Packages[i].Tests {
+				tests[report.Packages[i].Tests[j].Name] = &report.Packages[i].Tests[j]
+			}
+			report.index[report.Packages[i].Name] = tests
+		}
+	}
+	return report.index[pkg][name]
+}
+
+func (report *Report) add(name string, duration float64, results []*TestResult, benchmarks []Benchmark, opts Options) {
+	if opts.Follow {
+		// Output being followed could go on for ever, so every test's output can't be kept til the end
+		return
+	}
+	reported := opts.filterTests(results)
+	if len(reported) == 0 && len(results) > 0 && len(benchmarks) == 0 {
+		return
+	}
+	pkg := Package{Name: name, Duration: duration, Benchmarks: benchmarks}
+	for _, test := range reported {
+		pkg.Tests = append(pkg.Tests, Test{
+			Name:        test.Name,
+			Status:      test.reportedStatus(opts),
+			Duration:    test.DurationSec,
+			Message:     test.reportedMessage(opts),
+			Output:      test.Output,
+			ErrorOutput: test.ErrorOutput,
+		})
+	}
+	report.Packages = append(report.Packages, pkg)
+}
+
+// The average of a metric across every run of a benchmark in a package, if it was measured at all
+func (report *Report) benchmarkMetric(pkg string, name string, unit string) (float64, bool) {
+	total := 0.0
+	runs := 0
+	for _, reported := range report.Packages {
+		if reported.Name != pkg {
+			continue
+		}
+		for _, benchmark := range reported.Benchmarks {
+			if value, ok := benchmark.Metrics[unit]; ok && benchmark.Name == name {
+				total += value
+				runs++
+			}
+		}
+	}
+	if runs == 0 {
+		return 0, false
+	}
+	return total / float64(runs), true
+}
+
+// Puts the packages, and the tests in each, in order of their names, as Sort has them reported
+func (report *Report) sort() {
+	sort.SliceStable(report.Packages, func(i, j int) bool { return report.Packages[i].Name < report.Packages[j].Name })
+	for _, pkg := range report.Packages {
+		tests := pkg.Tests
+		sort.SliceStable(tests, func(i, j int) bool { return tests[i].Name < tests[j].Name })
+	}
+}
+
+func (report *Report) addBuildFailure(name string, diagnostics []string) {
+	report.Packages = append(report.Packages, Package{Name: name, BuildFailed: true, Diagnostics: diagnostics})
+}
@@ -0,0 +1,1647 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+// Package teamcity converts standard Go test output to be all pretty in TeamCity
+// TeamCity reporting format: https://confluence.jetbrains.com/display/TCD7/Build+Script+Interaction+with+TeamCity#BuildScriptInteractionwithTeamCity-ReportingTests
+// Go test output is of the following form:
+//
+// === RUN testname
+// --- (PASS|FAIL|SKIP): testname (1.23s)
+// [failure output if applicable]
+// ...
+// (PASS|FAIL) [appears at the end of a succesful package of tests]
+// (ok|FAIL|?) packagename (4.56s)
+//
+// Unfortunately, stdout just gets plastered wherever, especially during parallel tests. Yay go?
+// Also unfortunately, we can't report completely realtime since we don't know the package name until it completes.
+// (With -json we do, so there Realtime can report each test as it goes.)
+//
+// Alternatively, ConvertJSON reads the output of `go test -json` instead, which tells us exactly which package and
+// test every line belongs to.
+package teamcity
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	// For parsing
+	// Go replaces the spaces in subtest names with underscores, but a name can still have them (a top-level test
+	// run by hand through testing.RunTests, say), so a name is the rest of the line, short of a finish's duration
+	testRunPattern      = regexp.MustCompile(`^\s*=== RUN\s+(\S.*?)\s*$`)
+	testPausePattern    = regexp.MustCompile(`^=== PAUSE\s+(\S.*?)\s*$`)
+	testContinuePattern = regexp.MustCompile(`^=== CONT\s+(\S.*?)\s*$`)
+	// Newer versions of Go say whose output follows whenever that changes, without a name it's nobody's
+	testNamePattern      = regexp.MustCompile(`^=== NAME\s*(.*?)\s*$`)
+	testFinishPattern    = regexp.MustCompile(`^\s*--- (PASS|FAIL|SKIP):\s+(\S.*?)(?:\s+\(([^)]*)\))?\s*$`)
+	packageFinishPattern = regexp.MustCompile(`^(ok|FAIL|\?)\s+(\S.*)$`)
+	// Where the summary on a package's finish line starts, if it isn't separated from the package by a tab
+	summaryStartPattern = regexp.MustCompile(`\s+((?:[\d.]+(?:ns|us|µs|ms|s|m|h))+(?:\s|$)|\(cached\)|\[|coverage: )`)
+	buildFailedPattern  = regexp.MustCompile(`^FAIL\s+(\S.*?) \[build failed\]`)
+	diagnosticPattern   = regexp.MustCompile(`^(# \S+|\S+:\d+:\d+: )`)
+	// A finding of go vet's, which may or may not have a column
+	vetPattern       = regexp.MustCompile(`^(\S+\.go):(\d+)(?::\d+)?: (.+)$`)
+	benchmarkPattern = regexp.MustCompile(`^(Benchmark\S*?)(-\d+)?\s+(\d+)\s+(\d.*)$`)
+	// With -v, each benchmark's name is printed by itself before it runs
+	benchmarkHeaderPattern = regexp.MustCompile(`^(Benchmark\S*)$`)
+	benchmarkMetricPattern = regexp.MustCompile(`([\d.]+)\s+(\S+)`)
+	// What benchmarks print about the machine before the first of them runs
+	benchmarkInfoPattern = regexp.MustCompile(`^(goos|goarch|pkg|cpu): `)
+	// A test binary's verdict and exit code, which the package's finish line repeats anyway
+	// As it does when -run didn't match any of the package's tests
+	cruftPattern           = regexp.MustCompile(`^(PASS|FAIL|exit status \d+|testing: warning: no tests to run)$`)
+	verdictPattern         = regexp.MustCompile(`^(PASS|FAIL)$`)
+	packageDurationPattern = regexp.MustCompile(`^((?:[\d.]+(?:ns|us|µs|ms|s|m|h))+)`)
+	// With -cover, printed on a line of its own before the package's finish line, and again at the end of it if it passed
+	coveragePattern = regexp.MustCompile(`^coverage: (?:([\d.]+)% of statements|\[no statements\])`)
+	// Packages without tests still have their coverage reported with -cover, just without the "?"
+	untestedPackagePattern = regexp.MustCompile(`^\s+(\S.*?)\s+coverage: `)
+	panicPattern           = regexp.MustCompile(`^panic: `)
+	timeoutPattern         = regexp.MustCompile(`^panic: test timed out`)
+	// The race detector's reports are wrapped in these, see runtime/race
+	raceDelimiterPattern = regexp.MustCompile(`^={18}$`)
+	raceWarningPattern   = regexp.MustCompile(`^WARNING: DATA RACE`)
+	// The tally that gotestsum and the like end with, e.g. "DONE 12 tests, 1 skipped, 2 failures in 3.456s"
+	testSummaryPattern  = regexp.MustCompile(`^DONE (?:\d+ runs?, )?(\d+) tests?((?:, \d+ [a-z]+)*) in \S+$`)
+	summaryCountPattern = regexp.MustCompile(`, (\d+) ([a-z]+)`)
+	// Lines that test2json passes along as output, but which we get as structured events anyway
+	framingPattern = regexp.MustCompile(`^\s*(=== (RUN|PAUSE|CONT|NAME)|--- (PASS|FAIL|SKIP):)`)
+	// A line of `go test -json` output (or gotestsum's --jsonfile, which is the same), read without -json
+	jsonEventPattern = regexp.MustCompile(`^\{"(Time|Action)":`)
+	// As in GoVersion, e.g. 1.22, go1.22 or 1.22.3
+	goVersionPattern = regexp.MustCompile(`^(?:go)?1\.(\d+)(?:\.\d+)?$`)
+	// Colours, from richgo and the like
+	ansiPattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	// For failure messages
+	testifyErrorPattern = regexp.MustCompile(`(?m)Error:\s+(.+)$`)
+	sourceLinePattern   = regexp.MustCompile(`(?m)^\s*(\S+\.go:\d+: .*\S)\s*$`)
+	failureWordsPattern = regexp.MustCompile(`(?i)\b(fail\w*|error\w*|expected|want\w*|got|unexpected|mismatch\w*|wrong|invalid|missing|should|must)\b`)
+	fuzzInputPattern    = regexp.MustCompile(`Failing input written to (\S+)`)
+	// For comparison failures
+	expectedValuePattern = regexp.MustCompile(`(?m)^\s*(?:\S+\.go:\d+: )?expected\s*: (.*?)\s*$`)
+	actualValuePattern   = regexp.MustCompile(`(?m)^\s*(?:\S+\.go:\d+: )?actual\s*: (.*?)\s*$`)
+	// For statistic keys
+	disallowedKeyCharsPattern = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+	// For escaping
+	specialCharsPattern   = regexp.MustCompile(`\n|\r|\[|\]|\||'`)
+	nonAsciiCharsPattern  = regexp.MustCompile(`[\x00-\x20]|[\x80-\x{10ffff}]`)
+	serviceMessagePattern = regexp.MustCompile(`##teamcity\[`)
+)
+
+// Options are everything about how the input is converted, DefaultOptions for what the command line defaults to
+type Options struct {
+	// StripANSI removes ANSI colour codes from the input before parsing it
+	StripANSI bool
+	// CapturePass attaches the output of passing tests to them, not just that of failing ones
+	CapturePass bool
+	// CaptureStandardOutput has TeamCity attach everything printed during a test to it
+	// Otherwise, only the output we attach explicitly (with testStdOut) is
+	CaptureStandardOutput bool
+	// Timestamps adds when each test started and finished to its service messages, rather than leaving TeamCity
+	// to assume it was whenever the messages were read
+	Timestamps bool
+	// MaxOutputBytes, if more than 0, is as much of a test's output as is attached to it, the rest is left out
+	// Its failure message is still found in the whole of it
+	MaxOutputBytes int
+	// OutputChunkBytes, if more than 0, splits the output attached to a test into messages of no more than that much
+	// each (before escaping), since TeamCity can drop a message that's too big rather than show it
+	OutputChunkBytes int
+	// MaxLineSize is the longest line of input we'll read, a huge diff or stack trace can easily run past bufio's default
+	// (which is what 0 leaves it at)
+	MaxLineSize int
+	// TrimPrefix is removed from the start of package names where they're shown as suites, e.g. the module path
+	TrimPrefix string
+	// Format is what the results are written as, FormatTeamCity (or "" for the same), FormatJUnit or FormatJSON
+	Format string
+	// JSONReport, if set, is also written the results as a Report in JSON once all the input has been read, whatever
+	// the Format, e.g. to keep as an artifact while TeamCity is sent service messages
+	JSONReport io.Writer
+	// Include, if set, is the only tests that are reported, by their full name (e.g. TestFoo/bar) rather than package
+	Include *regexp.Regexp
+	// Exclude, if set, is the tests that aren't reported, same again
+	Exclude *regexp.Regexp
+	// FailOnSkip reports skipped tests as failures
+	FailOnSkip bool
+	// Muted, if set, is the tests known to be flaky, by their full name, whose failures are reported as ignored so
+	// they don't fail the build
+	Muted *regexp.Regexp
+	// Blocks puts everything written for a package in a collapsible block named for it
+	// It's all held until the package finishes, since until then we (in the text format, at least) don't know its name
+	Blocks bool
+	// Prefix goes before the name of every suite and test, e.g. to tell apart the same tests run on different platforms
+	Prefix string
+	// ArtifactPattern, if set, finds files a test wrote in its output, to be linked to it in TeamCity
+	// Its last group is the path, e.g. `ARTIFACT: (\S+)`
+	ArtifactPattern *regexp.Regexp
+	// BenchmarkBaseline is the results of an earlier run, to fail any benchmark that allocates more than it did then
+	BenchmarkBaseline *Report
+	// BenchmarkThreshold is how much more, as a percentage, a benchmark can allocate than in BenchmarkBaseline
+	BenchmarkThreshold float64
+	// BenchmarksAsTests reports each benchmark as a test too, as well as its statistics, rather than only those that
+	// fail or skip
+	BenchmarksAsTests bool
+	// Baseline is the results of an earlier run, for pointing out which tests have started or stopped failing since
+	Baseline *Report
+	// Vet reports go vet's findings in the input (and anything else like them, such as compiler errors) as
+	// inspections, as well as passing them through
+	Vet bool
+	// MessagePattern, if set, finds a failing test's message in its output, ahead of anything we'd look for
+	// Its first group is the message, if it has one, e.g. `FAILURE REASON: (.*)`
+	MessagePattern *regexp.Regexp
+	// Flat reports tests by their package and full name, rather than in suites for packages and parent tests
+	Flat bool
+	// ShortNames shows packages as suites named for only the last element of their path
+	ShortNames bool
+	// GroupByDir, if more than 0, puts each package's suite in suites for the first that many elements of its path
+	// (after TrimPrefix), e.g. services and then auth for services/auth/token, to navigate a big tree by directory
+	// A package no deeper than that is only put in those above it, and there's no grouping with Flat or ShortNames
+	GroupByDir int
+	// CollapseSingle leaves out the suite for a package or parent test with only the one test in it, naming that
+	// test for both instead, e.g. example.com/foo.TestBar or TestBar/baz
+	CollapseSingle bool
+	// Realtime has ConvertJSON and ParseJSON report each test as it starts and finishes, rather than once its whole
+	// package has, with each test under its full name in its package's suite
+	// Only -json output says which package a test is in as it runs, so Convert and Parse don't do this
+	// Blocks holds each package's output until it finishes, which would put its block after its suite, so Realtime
+	// isn't for use with it
+	Realtime bool
+	// Follow is for reading output as it's written, e.g. of a long run, keeping nothing once its package has been
+	// reported. So there are no totals at the end, and no results at all for FormatJUnit, FormatJSON or JSONReport
+	Follow bool
+	// DurationRounding is how a test's duration is made a whole number of milliseconds for TeamCity, RoundNearest
+	// (or "" for the same), RoundDown or RoundUp
+	DurationRounding string
+	// DurationMetadata adds each test's duration as metadata too, which unlike its duration can be charted
+	DurationMetadata bool
+	// Quiet writes nothing but service messages, dropping the rest of the input rather than passing it through
+	// The output of failing tests is still attached to them, with testStdOut even if CaptureStandardOutput
+	Quiet bool
+	// MaxTestDuration, if more than 0, is how long a test can take before it's too slow, which is added to it as
+	// metadata and listed along with any others once all the input has been read
+	MaxTestDuration time.Duration
+	// FailSlow fails tests that pass but take longer than MaxTestDuration
+	FailSlow bool
+	// SummaryProblem reports a build problem once all the input has been read, if any tests failed, saying how many
+	// and naming the first few, for a headline on the build's page rather than only in its tests tab
+	SummaryProblem bool
+	// Sort reports packages in order of their names once all the input has been read, rather than as each finishes,
+	// and the tests in each in order of theirs, so the same tests come out the same way every time
+	// Not with Realtime or Follow, which are about not waiting for the end, or Blocks, which would all be empty
+	Sort bool
+	// GoVersion, if set, is the version of Go the tests were run with, e.g. 1.22, for its quirks rather than guessing
+	// at them. Before 1.14 a test's output followed its --- line rather than being printed as it went, so output
+	// straight after a test finishes is only ever taken for its with an earlier version (or none)
+	GoVersion string
+	// ShowUntested reports each package without test files as an empty suite, and with Blocks gives it a block,
+	// rather than leave it out as there's nothing to say about it
+	ShowUntested bool
+	// Strict collects every line that's passed through as it is, rather than reported as a test's output (TestMain's
+	// included) or a package's setup, and doesn't look like anything else we know of, and returns them as an
+	// UnrecognizedError once the input has been read, to catch Go's output changing under us
+	Strict bool
+}
+
+// DefaultOptions returns the Options that the zero value doesn't already give, as the command line has them
+func DefaultOptions() Options {
+	return Options{
+		StripANSI:             true,
+		CaptureStandardOutput: true,
+		MaxLineSize:           64 * 1024 * 1024,
+		Format:                FormatTeamCity,
+		DurationRounding:      RoundNearest,
+		BenchmarkThreshold:    10.0,
+	}
+}
+
+// The formats results can be written in
+const (
+	// FormatTeamCity streams TeamCity service messages, with anything else in the input passed through as-is
+	FormatTeamCity = "teamcity"
+	// FormatJUnit writes JUnit XML once all the input has been read, dropping anything else in it
+	FormatJUnit = "junit"
+	// FormatJSON writes a Report as JSON once all the input has been read, dropping anything else in it
+	FormatJSON = "json"
+)
+
+// The ways a duration can be rounded to the millisecond
+const (
+	// RoundNearest rounds halves up, so 1.5ms is 2ms, and is the closest to the real thing added up across many tests
+	RoundNearest = "round"
+	// RoundDown truncates, so 1.9ms is 1ms
+	RoundDown = "truncate"
+	// RoundUp makes anything more than a whole millisecond the next one, so 1.1ms is 2ms
+	RoundUp = "ceil"
+)
+
+// Whether a test's output can follow its --- line, as it did before Go 1.14, going by GoVersion
+// A version that can't be made sense of is taken as none at all
+func (opts Options) outputFollowsFinish() bool {
+	match := goVersionPattern.FindStringSubmatch(opts.GoVersion)
+	if match == nil {
+		return true
+	}
+	minor, _ := strconv.Atoi(match[1])
+	return minor < 14
+}
+
+// The whole milliseconds of a duration, rounded as DurationRounding says
+func (opts Options) milliseconds(duration time.Duration) int {
+	ms := float64(duration) / float64(time.Millisecond)
+	switch opts.DurationRounding {
+	case RoundDown:
+		return int(math.Floor(ms))
+	case RoundUp:
+		return int(math.Ceil(ms))
+	}
+	return int(math.Round(ms))
+}
+
+// ErrTestsFailed is returned once the whole of the input has been converted, if any test, package or build in it failed
+var ErrTestsFailed = errors.New("tests failed")
+
+// UnrecognizedError is returned with Options.Strict, in place of ErrTestsFailed, if the input had lines we didn't recognise
+type UnrecognizedError struct {
+	// Each different line, in the order they first appeared
+	Lines []string
+	// How many times each of them appeared
+	Counts map[string]int
+	strict bool
+}
+
+func (e *UnrecognizedError) Error() string {
+	total := 0
+	for _, count := range e.Counts {
+		total += count
+	}
+	message := fmt.Sprintf("%d unrecognised lines of input:", total)
+	for _, line := range e.Lines {
+		message += fmt.Sprintf("\n%6dx %s", e.Counts[line], line)
+	}
+	return message
+}
+
+// Keep hold of a line we couldn't make sense of, if Strict says to
+// Benchmarks' machine info and other tools' summaries we know of, they just aren't anything to report
+func (e *UnrecognizedError) add(line string) {
+	if !e.strict || benchmarkInfoPattern.MatchString(line) || testSummaryPattern.MatchString(line) {
+		return
+	}
+	if e.Counts == nil {
+		e.Counts = map[string]int{}
+	}
+	if e.Counts[line] == 0 {
+		e.Lines = append(e.Lines, line)
+	}
+	e.Counts[line]++
+}
+
+// The same for lines that were held onto in case they were a package's setup or TestMain's output, and weren't
+func (e *UnrecognizedError) addLines(lines []string) {
+	for _, line := range lines {
+		e.add(line)
+	}
+}
+
+// Either the error, or nil if there were no unrecognised lines at all
+func (e *UnrecognizedError) err() error {
+	if len(e.Lines) == 0 {
+		return nil
+	}
+	return e
+}
+
+const newFailureMarker = "[new failure] "
+
+const mutedMessage = "Muted flaky test"
+
+const dataRaceMessage = "DATA RACE detected"
+
+const incompleteMessage = "Test incomplete, the output ended before it finished"
+
+// TestResult is everything we know about a single test, once it has finished
+type TestResult struct {
+	Name        string
+	Status      string // PASS, FAIL or SKIP
+	Message     string // Failure message, if known better than whatever Flush can dig out of the output, or why it skipped
+	Output      []string
+	ErrorOutput []string // What we reckon went to stderr rather than stdout
+	DurationSec float64
+	Started     time.Time
+	Finished    time.Time
+	panicked    bool    // Everything after a panic is its stack trace, which goes to stderr
+	streamed    bool    // Whether Realtime has already reported it starting
+	raced       bool    // Whether the race detector reported a race while it ran
+	subtestsSec float64 // How much of DurationSec its subtests took
+	// Those of its subtests that failed, which may be all that's wrong with it
+	failedSubtests []*TestResult
+}
+
+func (test *TestResult) appendOutput(line string, stderr bool) {
+	if stderr || test.panicked {
+		test.ErrorOutput = append(test.ErrorOutput, line)
+	} else {
+		test.Output = append(test.Output, line)
+	}
+}
+
+// A race fails the test it happened in, even when Go says it passed, as it can if the race detector only reports it
+// once the test has otherwise finished
+func (test *TestResult) failIfRaced() {
+	if !test.raced || test.Status != "PASS" {
+		return
+	}
+	test.Status = "FAIL"
+	if test.Message == "" {
+		test.Message = dataRaceMessage
+	}
+}
+
+// A subtest's time is part of its parent's, which is only reported as what's left of it, see ownDuration
+// Its failure fails its parent too, which may have nothing else to say about it, see failedThroughSubtests
+func (test *TestResult) addToParent(results []*TestResult) {
+	i := strings.LastIndex(test.Name, "/")
+	if i == -1 {
+		return
+	}
+	if parent := findTest(test.Name[:i], results); parent != nil {
+		parent.subtestsSec += test.DurationSec
+		if test.Status == "FAIL" {
+			parent.failedSubtests = append(parent.failedSubtests, test)
+		}
+	}
+}
+
+// Whether the test only failed because some of its subtests did, without a failure of its own in its output
+func (test *TestResult) failedThroughSubtests() bool {
+	if test.Status != "FAIL" || len(test.failedSubtests) == 0 || test.Message != "" {
+		return false
+	}
+	for _, lines := range [][]string{test.ErrorOutput, test.Output} {
+		output := strings.Join(lines, "\n")
+		if testifyErrorPattern.MatchString(output) || sourceLinePattern.MatchString(output) {
+			return false
+		}
+	}
+	return true
+}
+
+// Which of its subtests a test failed through, e.g. subtest case_one failed
+func (test *TestResult) subtestsMessage() string {
+	var names []string
+	for _, subtest := range test.failedSubtests {
+		names = append(names, strings.TrimPrefix(subtest.Name, test.Name+"/"))
+	}
+	if len(names) == 1 {
+		return "subtest " + names[0] + " failed"
+	}
+	return "subtests " + strings.Join(names, ", ") + " failed"
+}
+
+// The test's duration less its subtests', since TeamCity adds up the durations in a suite, which the parent's is in
+// along with the suite of its subtests
+func (test *TestResult) ownDuration() time.Duration {
+	seconds := test.DurationSec - test.subtestsSec
+	if seconds < 0 {
+		// Parallel subtests can take longer between them than their parent did
+		seconds = 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Escape makes a string safe to use as an attribute value in a service message
+func Escape(input string) string {
+	// TC escaping is described here https://confluence.jetbrains.com/display/TCD7/Build+Script+Interaction+with+TeamCity#BuildScriptInteractionwithTeamCity-servMsgsServiceMessages
+	specEscape := func(in string) string {
+		if in == "\n" {
+			return "|n"
+		} else if in == "\r" {
+			return "|r"
+		} else {
+			return "|" + in
+		}
+	}
+	// Backslashes aren't special to TC, so Windows paths go through as they are
+	input = specialCharsPattern.ReplaceAllStringFunc(input, specEscape)
+	unicodeEscape := func(in string) string {
+		r, _ := utf8.DecodeRuneInString(in)
+		// TC only takes 4 hex digits, which it reads as a UTF-16 code unit (it's Java)
+		// So anything past U+FFFF, like emoji, goes as a surrogate pair
+		if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+			return fmt.Sprintf("|0x%04x|0x%04x", r1, r2)
+		}
+		return fmt.Sprintf("|0x%04x", r)
+	}
+	return nonAsciiCharsPattern.ReplaceAllStringFunc(input, unicodeEscape)
+}
+
+// defang makes output that's written as-is safe from being taken for service messages of its own
+// TeamCity looks for them anywhere in a line, so a test logging another tool's output could otherwise mess up its report
+func defang(output string) string {
+	return serviceMessagePattern.ReplaceAllString(output, "##teamcity|[")
+}
+
+// testNode is a single segment of a test's name, so subtests can be reported as a tree of suites
+// e.g. TestFoo/subcase_one is the node subcase_one under node TestFoo
+// Names are reported as Go printed them, we can't know which underscores were originally spaces
+type testNode struct {
+	name string
+	// Every run of the test, there's more than one with -count or a retry wrapper
+	// TeamCity counts each of them, and will notice if they disagree
+	results  []*TestResult
+	children []*testNode
+}
+
+func (node *testNode) child(name string) *testNode {
+	for _, child := range node.children {
+		if child.name == name {
+			return child
+		}
+	}
+	child := &testNode{name: name}
+	node.children = append(node.children, child)
+	return child
+}
+
+// How long the tests took between them, where a parent test's duration already includes its subtests'
+func (node *testNode) duration() time.Duration {
+	var total time.Duration
+	if len(node.results) > 0 {
+		for _, result := range node.results {
+			total += time.Duration(result.DurationSec * float64(time.Second))
+		}
+		return total
+	}
+	for _, child := range node.children {
+		total += child.duration()
+	}
+	return total
+}
+
+// The span of time covered by the tests, for the timestamps of the suite containing them
+func (node *testNode) timeSpan() (started time.Time, finished time.Time) {
+	for _, result := range node.results {
+		if started.IsZero() || (!result.Started.IsZero() && result.Started.Before(started)) {
+			started = result.Started
+		}
+		if result.Finished.After(finished) {
+			finished = result.Finished
+		}
+	}
+	for _, child := range node.children {
+		childStarted, childFinished := child.timeSpan()
+		if started.IsZero() || (!childStarted.IsZero() && childStarted.Before(started)) {
+			started = childStarted
+		}
+		if childFinished.After(finished) {
+			finished = childFinished
+		}
+	}
+	return started, finished
+}
+
+func buildTestTree(results []*TestResult) *testNode {
+	root := &testNode{}
+	for _, test := range results {
+		node := root
+		for _, segment := range strings.Split(test.Name, "/") {
+			node = node.child(segment)
+		}
+		node.results = append(node.results, test)
+	}
+	return root
+}
+
+func (node *testNode) flush(handle func(Event), pkg string, opts Options) {
+	// A parent test is reported both as a test in its own right (for its own assertions)
+	// and as a suite holding its subtests
+	name := opts.prefixed(node.name)
+	for _, result := range node.results {
+		result.emit(handle, name, pkg, opts)
+	}
+	if only := node.onlyChild(opts); only != nil {
+		for _, result := range only.results {
+			result.emit(handle, name+"/"+only.name, pkg, opts)
+		}
+	} else if len(node.children) > 0 {
+		started, finished := node.timeSpan()
+		handle(SuiteStarted{Name: name, Package: pkg, Time: started})
+		for _, child := range node.children {
+			child.flush(handle, pkg, opts)
+		}
+		handle(SuiteFinished{Name: name, Package: pkg, Duration: node.duration(), Time: finished})
+	}
+}
+
+// Puts the tests beneath this one in order of their names, as Sort has them reported
+func (node *testNode) sort() {
+	sort.SliceStable(node.children, func(i, j int) bool { return node.children[i].name < node.children[j].name })
+	for _, child := range node.children {
+		child.sort()
+	}
+}
+
+// The one test beneath this one, with CollapseSingle and only if it has no subtests of its own, otherwise nil
+func (node *testNode) onlyChild(opts Options) *testNode {
+	if !opts.CollapseSingle || len(node.children) != 1 || len(node.children[0].children) > 0 {
+		return nil
+	}
+	return node.children[0]
+}
+
+// Flush writes the service messages for this test, under the given name (which may be just the last part of
+// a subtest's name) and flowId
+func (test *TestResult) Flush(w io.Writer, name string, flowID string, opts Options) {
+	test.emit(TeamCityHandler(w, opts), name, flowID, opts)
+}
+
+func (test *TestResult) emit(handle func(Event), name string, pkg string, opts Options) {
+	test.start(handle, name, pkg)
+	test.finish(handle, name, pkg, opts)
+}
+
+func (test *TestResult) start(handle func(Event), name string, pkg string) {
+	handle(TestStarted{Name: name, Package: pkg, Flow: test.flow(pkg), Time: test.Started})
+}
+
+// Each test streamed by Realtime has its own flow, named for it, otherwise this is empty
+func (test *TestResult) flow(pkg string) string {
+	if !test.streamed {
+		return ""
+	}
+	return pkg + "/" + test.Name
+}
+
+func (test *TestResult) finish(handle func(Event), name string, pkg string, opts Options) {
+	if len(test.Output) > 0 {
+		for _, chunk := range splitOutput(truncateOutput(test.Output, opts.MaxOutputBytes), opts.OutputChunkBytes) {
+			handle(Output{Test: name, Package: pkg, Flow: test.flow(pkg), Text: chunk, Time: test.Finished})
+		}
+	}
+	if len(test.ErrorOutput) > 0 {
+		for _, chunk := range splitOutput(truncateOutput(test.ErrorOutput, opts.MaxOutputBytes), opts.OutputChunkBytes) {
+			handle(Output{Test: name, Package: pkg, Flow: test.flow(pkg), Text: chunk, Stderr: true, Time: test.Finished})
+		}
+	}
+	finished := TestFinished{
+		Name:     name,
+		Package:  pkg,
+		Flow:     test.flow(pkg),
+		Status:   test.reportedStatus(opts),
+		Duration: test.ownDuration(),
+		Message:  test.reportedMessage(opts),
+		Time:     test.Finished,
+	}
+	if test.slow(opts) {
+		finished.Slow = test.slowness(opts)
+	}
+	if test.Status == "FAIL" {
+		finished.Expected, finished.Actual, finished.Compared = test.comparison()
+	}
+	finished.Artifacts = test.artifacts(opts.ArtifactPattern)
+	if opts.Baseline != nil {
+		// Only going from passing to failing or back is interesting, the rest is just tests coming and going
+		if before := opts.Baseline.findTest(pkg, test.Name); before != nil && before.Status != finished.Status &&
+			(before.Status == "PASS" || before.Status == "FAIL") && (finished.Status == "PASS" || finished.Status == "FAIL") {
+			finished.Baseline = before.Status
+			if finished.Status == "FAIL" {
+				finished.Message = newFailureMarker + finished.Message
+			}
+		}
+	}
+	handle(finished)
+}
+
+// The output as it's attached to the test, cut short to maxBytes
+func truncateOutput(lines []string, maxBytes int) string {
+	text := strings.Join(lines, "\n")
+	if maxBytes <= 0 || len(text) <= maxBytes {
+		return text
+	}
+	end := maxBytes
+	// Not in the middle of a character
+	for end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return text[:end] + "\n[truncated]"
+}
+
+// The output in pieces of no more than maxBytes (or all in one, for 0), each ending at the end of a line if there's
+// one to be had and otherwise between characters, so escaping each piece comes out the same as escaping the whole
+func splitOutput(text string, maxBytes int) []string {
+	if maxBytes <= 0 {
+		return []string{text}
+	}
+	var chunks []string
+	for len(text) > maxBytes {
+		if end := strings.LastIndex(text[:maxBytes+1], "\n"); end > 0 {
+			// The newline goes between pieces, each of which is written as lines of its own
+			chunks = append(chunks, text[:end])
+			text = text[end+1:]
+			continue
+		}
+		end := maxBytes
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		if end == 0 {
+			// No room for even one character, so it goes on its own
+			_, end = utf8.DecodeRuneInString(text)
+		}
+		chunks = append(chunks, text[:end])
+		text = text[end:]
+	}
+	return append(chunks, text)
+}
+
+// The files the test said it wrote, going by the ArtifactPattern
+func (test *TestResult) artifacts(pattern *regexp.Regexp) []string {
+	if pattern == nil {
+		return nil
+	}
+	var paths []string
+	for _, line := range append(append([]string{}, test.Output...), test.ErrorOutput...) {
+		match := pattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		// Whatever it matched, if it doesn't single out the path itself
+		paths = append(paths, match[len(match)-1])
+	}
+	return paths
+}
+
+// Why the test failed or skipped, if it did
+func (test *TestResult) reportedMessage(opts Options) string {
+	if test.Status == "FAIL" {
+		// We need a message for TC to properly recognize the failure
+		// So, try to come up with something succinct
+		message := test.failureMessage(opts.MessagePattern)
+		if test.muted(opts) && message != "" {
+			return mutedMessage + ": " + message
+		} else if test.muted(opts) {
+			return mutedMessage
+		}
+		return message
+	}
+	if test.Status == "PASS" && opts.FailSlow && test.slow(opts) {
+		return "Too slow, took " + test.slowness(opts)
+	}
+	if test.Status == "SKIP" && opts.FailOnSkip {
+		if test.Message == "" {
+			return "Test skipped"
+		}
+		return "Test skipped: " + test.Message
+	}
+	if test.Status == "SKIP" {
+		return test.Message
+	}
+	return ""
+}
+
+// The status we report, which is only different from how Go saw it with FailOnSkip or Muted
+func (test *TestResult) reportedStatus(opts Options) string {
+	if test.muted(opts) {
+		return "SKIP"
+	}
+	if test.Status == "SKIP" && opts.FailOnSkip {
+		return "FAIL"
+	}
+	if test.Status == "PASS" && opts.FailSlow && test.slow(opts) {
+		return "FAIL"
+	}
+	return test.Status
+}
+
+// Whether the test took longer than MaxTestDuration, going by the duration reported for it
+func (test *TestResult) slow(opts Options) bool {
+	return opts.MaxTestDuration > 0 && test.Status != "SKIP" &&
+		opts.milliseconds(test.ownDuration()) > opts.milliseconds(opts.MaxTestDuration)
+}
+
+// How much too long a slow test took, e.g. 1234ms, more than the 500ms allowed
+func (test *TestResult) slowness(opts Options) string {
+	return fmt.Sprintf("%dms, more than the %dms allowed", opts.milliseconds(test.ownDuration()), opts.milliseconds(opts.MaxTestDuration))
+}
+
+// Whether this is a failure of a known flaky test, or of a parent only through its subtests' that all are
+func (test *TestResult) muted(opts Options) bool {
+	if test.Status != "FAIL" || opts.Muted == nil {
+		return false
+	}
+	if opts.Muted.MatchString(test.Name) {
+		return true
+	}
+	if !test.failedThroughSubtests() {
+		return false
+	}
+	for _, subtest := range test.failedSubtests {
+		if !subtest.muted(opts) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether output should be attached to this test rather than passed through
+// A muted failure's is too, since it's still why it failed
+func (test *TestResult) shouldCapture(opts Options) bool {
+	return test.reportedStatus(opts) == "FAIL" || test.muted(opts) || opts.CapturePass
+}
+
+// Once a test has finished, whatever it printed is either kept to be reported with it, or let go
+func (test *TestResult) release(w io.Writer, opts Options) {
+	if test.Status == "SKIP" && test.Message == "" {
+		test.Message = test.skipReason()
+	}
+	if test.shouldCapture(opts) {
+		return
+	}
+	for _, line := range append(test.Output, test.ErrorOutput...) {
+		fmt.Fprintln(w, defang(line))
+	}
+	test.Output = nil
+	test.ErrorOutput = nil
+}
+
+// Whatever t.Skip said, which is printed just like a failure's output
+func (test *TestResult) skipReason() string {
+	if matches := sourceLinePattern.FindAllStringSubmatch(strings.Join(test.Output, "\n"), -1); matches != nil {
+		return matches[len(matches)-1][1]
+	}
+	return ""
+}
+
+func (test *TestResult) failureMessage(pattern *regexp.Regexp) string {
+	message := test.describeFailure(pattern)
+	// When fuzzing finds a crasher, where it was saved is the most useful thing we can say
+	for _, line := range test.Output {
+		if match := fuzzInputPattern.FindStringSubmatch(line); match != nil {
+			message += " (failing input written to " + match[1] + ")"
+			break
+		}
+	}
+	return message
+}
+
+func (test *TestResult) describeFailure(pattern *regexp.Regexp) string {
+	if len(test.Message) > 0 {
+		return test.Message
+	}
+	// Whatever the tests' own helpers say, if we've been told what that looks like
+	if pattern != nil {
+		for _, lines := range [][]string{test.ErrorOutput, test.Output} {
+			if match := pattern.FindStringSubmatch(strings.Join(lines, "\n")); len(match) > 1 {
+				return strings.TrimSpace(match[1])
+			} else if match != nil {
+				return strings.TrimSpace(match[0])
+			}
+		}
+	}
+	if test.failedThroughSubtests() {
+		return test.subtestsMessage()
+	}
+	if got, want, ok := exampleMismatch(test.Output); ok {
+		return fmt.Sprintf("got %q, want %q", got, want)
+	}
+	// Errors are the more likely to say what went wrong
+	for _, lines := range [][]string{test.ErrorOutput, test.Output} {
+		testOutput := strings.Join(lines, "\n")
+		// testify says exactly what went wrong
+		if message := testifyErrorPattern.FindString(testOutput); len(message) > 0 {
+			return message
+		}
+		// Otherwise, t.Errorf and friends are prefixed with where they were called from, but so is t.Log, and only
+		// -json can tell them apart, so it's the first that reads like a failure, or failing that just the first,
+		// which is where things first went wrong rather than whatever was logged about it after
+		if matches := sourceLinePattern.FindAllStringSubmatch(testOutput, -1); matches != nil {
+			for _, match := range matches {
+				if failureWordsPattern.MatchString(match[1]) {
+					return match[1]
+				}
+			}
+			return matches[0][1]
+		}
+	}
+	if len(test.Output) == 0 {
+		return strings.TrimSpace(strings.Join(test.ErrorOutput, "\n"))
+	}
+	return strings.TrimSpace(test.Output[0])
+}
+
+// What the test expected and actually got, if it said so in a way we recognise
+func (test *TestResult) comparison() (expected string, actual string, ok bool) {
+	if got, want, ok := exampleMismatch(test.Output); ok {
+		return want, got, true
+	}
+	for _, lines := range [][]string{test.ErrorOutput, test.Output} {
+		testOutput := strings.Join(lines, "\n")
+		// testify lines these up under its Error:, and plenty of plain tests print them the same way
+		expectedMatch := expectedValuePattern.FindStringSubmatch(testOutput)
+		actualMatch := actualValuePattern.FindStringSubmatch(testOutput)
+		if expectedMatch != nil && actualMatch != nil {
+			return expectedMatch[1], actualMatch[1], true
+		}
+	}
+	return "", "", false
+}
+
+// A failing example prints what it got and what it wanted, each on the lines following a "got:" and "want:"
+func exampleMismatch(lines []string) (got string, want string, ok bool) {
+	gotStart, wantStart := -1, -1
+	for i, line := range lines {
+		if line == "got:" && gotStart == -1 {
+			gotStart = i + 1
+		} else if line == "want:" && gotStart != -1 {
+			wantStart = i + 1
+		}
+	}
+	if wantStart == -1 {
+		return "", "", false
+	}
+	got = strings.Join(lines[gotStart:wantStart-1], "\n")
+	want = strings.Join(lines[wantStart:], "\n")
+	return got, want, true
+}
+
+// The timestamp attribute for a service message, if we're adding them
+func (opts Options) timestamp(t time.Time) string {
+	if !opts.Timestamps || t.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(" timestamp='%s'", Escape(t.Format("2006-01-02T15:04:05.000-0700")))
+}
+
+// FlushPackage writes a package's test results as a suite
+// The package name doubles as the flowId, so TeamCity can tell apart the messages of packages run in parallel
+func FlushPackage(w io.Writer, name string, results []*TestResult, opts Options) {
+	opts.flushPackage(TeamCityHandler(w, opts), name, results)
+}
+
+func (opts Options) flushPackage(handle func(Event), name string, results []*TestResult) {
+	reported := opts.filterTests(results)
+	if len(reported) == 0 {
+		// Leave out the whole package rather than have an empty suite of it, whether it's Include and Exclude or
+		// -run that left nothing of it
+		return
+	}
+	suite := opts.suiteName(name)
+	if opts.Flat {
+		if opts.Sort {
+			reported = append([]*TestResult{}, reported...)
+			// Stably, so the runs of a test with -count stay in the order they ran in
+			sort.SliceStable(reported, func(i, j int) bool { return reported[i].Name < reported[j].Name })
+		}
+		// Without any suites, each test's name has to say where it's from, e.g. example.com/foo.TestBar/baz
+		for _, test := range reported {
+			test.emit(handle, suite+"."+test.Name, name, opts)
+		}
+		return
+	}
+	tree := buildTestTree(reported)
+	if opts.Sort {
+		tree.sort()
+	}
+	started, finished := tree.timeSpan()
+	opts.openGroups(handle, name, started)
+	defer opts.closeGroups(handle, name, tree.duration(), finished)
+	if only := tree.onlyChild(opts); only != nil {
+		for _, test := range only.results {
+			test.emit(handle, suite+"."+only.name, name, opts)
+		}
+		return
+	}
+	handle(SuiteStarted{Name: suite, Package: name, Time: started})
+	for _, node := range tree.children {
+		node.flush(handle, name, opts)
+	}
+	handle(SuiteFinished{Name: suite, Package: name, Duration: tree.duration(), Time: finished})
+}
+
+// The suites GroupByDir puts a package's suite in, outermost first
+func (opts Options) groups(pkg string) []string {
+	if opts.GroupByDir <= 0 || opts.Flat || opts.ShortNames {
+		return nil
+	}
+	elements := strings.Split(opts.shownName(pkg), "/")
+	if len(elements) > opts.GroupByDir {
+		elements = elements[:opts.GroupByDir]
+	} else {
+		// The package itself is the last of them, and already has a suite
+		elements = elements[:len(elements)-1]
+	}
+	if len(elements) > 0 {
+		// The ones inside it say where they are already, but the outermost should say what it's from like any other
+		elements[0] = opts.prefixed(elements[0])
+	}
+	return elements
+}
+
+// TeamCity puts suites with the same name in the same place, so each package can start the groups it's in for itself
+func (opts Options) openGroups(handle func(Event), pkg string, started time.Time) {
+	for _, group := range opts.groups(pkg) {
+		handle(SuiteStarted{Name: group, Package: pkg, Time: started})
+	}
+}
+
+func (opts Options) closeGroups(handle func(Event), pkg string, duration time.Duration, finished time.Time) {
+	groups := opts.groups(pkg)
+	for i := len(groups) - 1; i >= 0; i-- {
+		handle(SuiteFinished{Name: groups[i], Package: pkg, Duration: duration, Time: finished})
+	}
+}
+
+// The tests that Include and Exclude say should be reported
+func (opts Options) filterTests(results []*TestResult) []*TestResult {
+	if opts.Include == nil && opts.Exclude == nil {
+		return results
+	}
+	var filtered []*TestResult
+	for _, test := range results {
+		if opts.Include != nil && !opts.Include.MatchString(test.Name) {
+			continue
+		}
+		if opts.Exclude != nil && opts.Exclude.MatchString(test.Name) {
+			continue
+		}
+		filtered = append(filtered, test)
+	}
+	return filtered
+}
+
+// What a package is called in TeamCity's tree, full module paths get unwieldy
+func (opts Options) suiteName(pkg string) string {
+	return opts.prefixed(opts.shownName(pkg))
+}
+
+// A package's name with TrimPrefix or ShortNames applied, but not Prefix
+func (opts Options) shownName(pkg string) string {
+	// Import paths always use forward slashes, but a directory outside of GOPATH or a module is named for its
+	// path on disk, backslashes and all on Windows
+	name := strings.Replace(pkg, "\\", "/", -1)
+	trim := strings.Replace(opts.TrimPrefix, "\\", "/", -1)
+	if opts.ShortNames {
+		name = path.Base(name)
+	} else if trim != "" && strings.HasPrefix(name, trim) {
+		name = strings.TrimPrefix(strings.TrimPrefix(name, trim), "/")
+	}
+	if name == "" {
+		// The package at the root of the module, or whatever was trimmed, still needs a name
+		name = pkg
+	}
+	return name
+}
+
+// The packages seen so far, so that one turning up again (as in the output of several runs put together) can be told apart
+type packageNames map[string]int
+
+func (names packageNames) unique(pkg string) string {
+	names[pkg]++
+	if names[pkg] == 1 {
+		return pkg
+	}
+	return fmt.Sprintf("%s (%d)", pkg, names[pkg])
+}
+
+func (opts Options) prefixed(name string) string {
+	if opts.Prefix == "" {
+		return name
+	}
+	return opts.Prefix + "/" + name
+}
+
+// The last test to start that hasn't yet finished, i.e. the one most likely responsible for whatever just happened
+func findRunningTest(results []*TestResult) *TestResult {
+	for i := len(results) - 1; i >= 0; i-- {
+		if results[i].Status == "" {
+			return results[i]
+		}
+	}
+	return nil
+}
+
+// Tests still running when the test binary times out, or when the output is cut short, are never going to get a result
+func failUnfinished(results []*TestResult, message string) {
+	for _, test := range results {
+		if test.Status == "" {
+			test.Status = "FAIL"
+			test.Message = message
+		}
+	}
+}
+
+// Finish off a package whose tests Realtime has been reporting as they went, including any that never finished
+// and any that it couldn't have, like a failing TestMain
+func (opts Options) finishStreamed(handle func(Event), pkg string, results []*TestResult, finished time.Time) {
+	for _, test := range results {
+		if test.streamed && test.Finished.IsZero() {
+			test.finish(handle, opts.prefixed(test.Name), pkg, opts)
+		} else if !test.streamed && len(opts.filterTests([]*TestResult{test})) > 0 {
+			test.emit(handle, opts.prefixed(test.Name), pkg, opts)
+		}
+	}
+	duration := buildTestTree(opts.filterTests(results)).duration()
+	handle(SuiteFinished{Name: opts.suiteName(pkg), Package: pkg, Duration: duration, Time: finished})
+	opts.closeGroups(handle, pkg, duration, finished)
+}
+
+// With ShowUntested, a package without test files is reported as a suite without any tests in it
+func (opts Options) reportUntested(handle func(Event), pkg string) {
+	opts.openGroups(handle, pkg, time.Time{})
+	handle(SuiteStarted{Name: opts.suiteName(pkg), Package: pkg})
+	handle(SuiteFinished{Name: opts.suiteName(pkg), Package: pkg})
+	opts.closeGroups(handle, pkg, 0, time.Time{})
+}
+
+// Whether the output is nothing but go test saying a package has [no test files], if anything
+func onlyUntested(output []string) bool {
+	for _, line := range output {
+		if match := matchPackageFinish(line); match == nil || match[1] != "?" {
+			return false
+		}
+	}
+	return true
+}
+
+// A package can fail without any of its tests having failed, when TestMain does (or a leak checker run from it), so
+// that's reported as a test of its own, with whatever the package printed outside of its tests as the message, all of
+// it, since what went wrong is as likely to be at the end (a leak found after the tests) as at the start
+// Without anything printed there's nothing to say about it, and the package is left as it is
+func (opts Options) packageFailure(results []*TestResult, output []string) *TestResult {
+	if opts.anyFailed(results) || opts.anyMuted(results) {
+		return nil
+	}
+	message := strings.TrimSpace(strings.Join(output, "\n"))
+	if message == "" {
+		return nil
+	}
+	test := &TestResult{Name: "TestMain", Status: "FAIL", Message: message, Finished: time.Now()}
+	for _, line := range output {
+		test.appendOutput(line, false)
+	}
+	return test
+}
+
+// If the output ends before a package does, flush what we have rather than leave TeamCity waiting on those tests forever
+func (opts Options) flushIncomplete(handle func(Event), pkg string, results []*TestResult) {
+	if len(results) == 0 {
+		return
+	}
+	failUnfinished(results, incompleteMessage)
+	opts.flushPackage(handle, pkg, results)
+}
+
+func (opts Options) anyFailed(results []*TestResult) bool {
+	for _, test := range results {
+		if test.reportedStatus(opts) == "FAIL" {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any of the tests failed but were muted, which is then why their package failed, but shouldn't fail the build
+func (opts Options) anyMuted(results []*TestResult) bool {
+	for _, test := range results {
+		if test.muted(opts) {
+			return true
+		}
+	}
+	return false
+}
+
+// The same test can run more than once, so this is its latest run that hasn't finished, or failing that its latest run
+func findTest(name string, results []*TestResult) *TestResult {
+	var latest *TestResult
+	for i := len(results) - 1; i >= 0; i-- {
+		if results[i].Name != name {
+			continue
+		}
+		if results[i].Finished.IsZero() {
+			return results[i]
+		}
+		if latest == nil {
+			latest = results[i]
+		}
+	}
+	return latest
+}
+
+// Fuzzing reports its run of a failing input under the fuzz target's own name, indented beneath the target's result
+func hasFinished(name string, results []*TestResult) bool {
+	test := findTest(name, results)
+	return test != nil && !test.Finished.IsZero()
+}
+
+// A benchmark writing its result is it passing
+// Returns the benchmark's test, if that's what happened
+func passBenchmark(w io.Writer, results []*TestResult, benchmark Benchmark, finished time.Time, opts Options) *TestResult {
+	test := findTest(benchmark.Name, results)
+	if test == nil || test.Status != "" {
+		return nil
+	}
+	test.Status = "PASS"
+	test.Finished = finished
+	// Its wall time, since it started, unless that's less than its last run took, as when reading saved output
+	test.DurationSec = finished.Sub(test.Started).Seconds()
+	if last := float64(benchmark.Iterations) * benchmark.Metrics["ns/op"] / float64(time.Second); last > test.DurationSec {
+		test.DurationSec = last
+	}
+	test.release(w, opts)
+	return test
+}
+
+// Benchmarks with sub-benchmarks have no result of their own, and but for their failures and skips they don't say
+// how they went, so any that are still running once their package has finished must have passed
+func passBenchmarks(results []*TestResult) {
+	for _, test := range results {
+		if test.Status == "" && strings.HasPrefix(test.Name, "Benchmark") {
+			test.Status = "PASS"
+		}
+	}
+}
+
+// Without BenchmarksAsTests, benchmarks are reported as tests only when they fail or skip, otherwise their results
+// are statistics and nothing more
+func (opts Options) reportedBenchmarks(results []*TestResult) []*TestResult {
+	if opts.BenchmarksAsTests {
+		return results
+	}
+	var reported []*TestResult
+	for _, test := range results {
+		if strings.HasPrefix(test.Name, "Benchmark") && test.Status == "PASS" {
+			continue
+		}
+		reported = append(reported, test)
+	}
+	return reported
+}
+
+func (opts Options) newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	if opts.MaxLineSize > 0 {
+		scanner.Buffer(make([]byte, 0, 64*1024), opts.MaxLineSize)
+	}
+	first := true
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		// This already drops the \r from the end of lines saved on Windows
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if first && token != nil {
+			// Output saved on Windows may start with a byte order mark, which would stop the first line matching anything
+			token = bytes.TrimPrefix(token, []byte("\ufeff"))
+			first = false
+		}
+		return advance, token, err
+	})
+	return scanner
+}
+
+// Where the output of a single package goes, which with Blocks is held until the package finishes
+type packageBlock struct {
+	w       io.Writer
+	blocks  bool
+	pending bytes.Buffer
+	opened  bool
+}
+
+func (block *packageBlock) Write(p []byte) (int, error) {
+	if !block.blocks || block.opened {
+		return block.w.Write(p)
+	}
+	return block.pending.Write(p)
+}
+
+// Whether anything at all has been written since the last block
+func (block *packageBlock) empty() bool {
+	return block.pending.Len() == 0
+}
+
+// Open the block, with everything held so far in it
+// Until it's closed, anything else is written straight into it
+func (block *packageBlock) open(pkg string) {
+	if !block.blocks {
+		return
+	}
+	fmt.Fprintf(block.w, "##teamcity[blockOpened name='%s']\n", Escape(pkg))
+	block.w.Write(block.pending.Bytes())
+	block.pending.Reset()
+	block.opened = true
+}
+
+func (block *packageBlock) close(pkg string) {
+	if !block.blocks {
+		return
+	}
+	fmt.Fprintf(block.w, "##teamcity[blockClosed name='%s']\n", Escape(pkg))
+	block.opened = false
+}
+
+// Where the converters write their service messages, which for other formats aren't wanted at all
+func (opts Options) messageWriter(w io.Writer) io.Writer {
+	if opts.Format != FormatTeamCity && opts.Format != "" {
+		return io.Discard
+	}
+	if opts.Quiet {
+		return quietWriter{w}
+	}
+	return w
+}
+
+// Drops every line written to it that isn't a service message
+// Everything is written a whole line (or several) at a time, so each write can be taken line by line
+type quietWriter struct {
+	w io.Writer
+}
+
+func (quiet quietWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("##teamcity[")) {
+			if _, err := quiet.w.Write(line); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Both converters end the same way, with anything that needed all the results written out
+func (opts Options) finishConversion(w io.Writer, report *Report, failed bool, err error) error {
+	if opts.Sort {
+		report.sort()
+	}
+	switch opts.Format {
+	case FormatJUnit:
+		if err := WriteJUnit(w, report); err != nil {
+			return err
+		}
+	case FormatJSON:
+		if err := WriteJSON(w, report); err != nil {
+			return err
+		}
+	}
+	if opts.JSONReport != nil {
+		if err := WriteJSON(opts.JSONReport, report); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if failed {
+		return ErrTestsFailed
+	}
+	return nil
+}
+
+// Stopping short means we've missed everything after, so say why
+func (opts Options) scanError(scanner *bufio.Scanner) error {
+	err := scanner.Err()
+	if err == bufio.ErrTooLong {
+		return fmt.Errorf("stopped reading at a line longer than %d bytes, so the remaining tests are unreported: %v", opts.MaxLineSize, err)
+	}
+	return err
+}
+
+// A package's finish line, split into the line, status, package and summary (e.g. "0.123s" or "(cached)") the same
+// as FindStringSubmatch would, or nil if it isn't one
+// The package is everything up to the summary rather than just the first word, since one named for a directory
+// outside of GOPATH or a module can have spaces in it. go test puts a tab between them, but it may not have survived
+func matchPackageFinish(line string) []string {
+	match := packageFinishPattern.FindStringSubmatch(line)
+	if match == nil {
+		return nil
+	}
+	pkg, summary := match[2], ""
+	if i := strings.Index(pkg, "\t"); i != -1 {
+		pkg, summary = pkg[:i], pkg[i+1:]
+	} else if loc := summaryStartPattern.FindStringIndex(pkg); loc != nil {
+		pkg, summary = pkg[:loc[0]], pkg[loc[0]:]
+	}
+	return []string{match[0], match[1], strings.TrimSpace(pkg), strings.TrimSpace(summary)}
+}
+
+// How long the package took, in seconds, if its finish line says
+func packageDuration(packageSummary string) float64 {
+	match := packageDurationPattern.FindStringSubmatch(packageSummary)
+	if match == nil {
+		return 0
+	}
+	// Always seconds, as it happens, but the same as a test's duration otherwise
+	duration, err := time.ParseDuration(match[1])
+	if err != nil {
+		return 0
+	}
+	return duration.Seconds()
+}
+
+// The package's own idea of how long it took, which unlike its suite's doesn't depend on its tests saying
+func reportPackageDuration(w io.Writer, pkg string, seconds float64) {
+	if seconds > 0 {
+		reportStatistic(w, "PackageDuration."+pkg, strconv.Itoa(int(math.Round(seconds*1000))))
+	}
+}
+
+// Whatever follows the package name on its finish line, e.g. "0.123s" or "(cached)"
+func isCached(packageSummary string) bool {
+	return strings.Contains(packageSummary, "(cached)")
+}
+
+func reportCached(w io.Writer, pkg string) {
+	fmt.Fprintf(w, "##teamcity[message text='%s' flowId='%s']\n", Escape("Test results for "+pkg+" were cached"), Escape(pkg))
+}
+
+// A package run with -run that didn't match any of its tests says as much after its duration
+func noTestsRun(packageSummary string) bool {
+	return strings.Contains(packageSummary, "[no tests to run]")
+}
+
+func reportNoTestsRun(w io.Writer, pkg string) {
+	fmt.Fprintf(w, "##teamcity[message text='%s' flowId='%s']\n", Escape("None of the tests in "+pkg+" were run"), Escape(pkg))
+}
+
+// Coverage across packages, so we can report an average at the end
+type coverageStats struct {
+	total    float64
+	packages int
+}
+
+func (stats *coverageStats) report(w io.Writer, pkg string, packageSummary string) {
+	if i := strings.Index(packageSummary, "coverage: "); i >= 0 {
+		packageSummary = packageSummary[i:]
+	}
+	match := coveragePattern.FindStringSubmatch(packageSummary)
+	if match == nil || match[1] == "" {
+		// Without any statements, there's nothing to have covered
+		return
+	}
+	coverage, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return
+	}
+	stats.total += coverage
+	stats.packages++
+	reportStatistic(w, "CodeCoverageL."+pkg, match[1])
+}
+
+func (stats *coverageStats) reportAverage(w io.Writer) {
+	if stats.packages > 0 {
+		reportStatistic(w, "CodeCoverageL", fmt.Sprintf("%.1f", stats.total/float64(stats.packages)))
+	}
+}
+
+// Totals across every package, so TeamCity can chart them across builds
+type testCounts struct {
+	total, passed, failed, ignored int
+	// As Go saw them, whatever was or wasn't reported, to check against a summary of its own
+	ran, ranFailed, ranSkipped int
+	// The first few of the tests that failed, by package and full name, for SummaryProblem
+	failedNames []string
+	// Every test that took longer than MaxTestDuration, the same way, along with how long it took
+	slow []string
+}
+
+// How many failing tests SummaryProblem names, the rest are only counted
+const summaryProblemNames = 5
+
+func (counts *testCounts) add(pkg string, results []*TestResult, opts Options) {
+	for _, test := range results {
+		counts.ran++
+		switch test.Status {
+		case "FAIL":
+			counts.ranFailed++
+		case "SKIP":
+			counts.ranSkipped++
+		}
+	}
+	for _, test := range opts.filterTests(results) {
+		if test.slow(opts) {
+			counts.slow = append(counts.slow, fmt.Sprintf("%s.%s (%dms)", pkg, test.Name, opts.milliseconds(test.ownDuration())))
+		}
+		if test.failedThroughSubtests() && test.reportedStatus(opts) == "FAIL" {
+			// Its subtests' failures are counted already, and they're all that's wrong with it
+			continue
+		}
+		counts.total++
+		switch test.reportedStatus(opts) {
+		case "PASS":
+			counts.passed++
+		case "FAIL":
+			counts.failed++
+			if len(counts.failedNames) < summaryProblemNames {
+				counts.failedNames = append(counts.failedNames, pkg+"."+test.Name)
+			}
+		case "SKIP":
+			counts.ignored++
+		}
+	}
+}
+
+func (counts *testCounts) report(w io.Writer) {
+	if counts.total == 0 {
+		return
+	}
+	reportStatistic(w, "TestCount", strconv.Itoa(counts.total))
+	reportStatistic(w, "PassedTestCount", strconv.Itoa(counts.passed))
+	reportStatistic(w, "FailedTestCount", strconv.Itoa(counts.failed))
+	reportStatistic(w, "IgnoredTestCount", strconv.Itoa(counts.ignored))
+}
+
+// One build problem for all the tests that failed, so why the build failed is the first thing on its page
+func (counts *testCounts) reportProblem(w io.Writer) {
+	if counts.failed == 0 {
+		return
+	}
+	description := fmt.Sprintf("%d tests failed", counts.failed)
+	if counts.failed == 1 {
+		description = "1 test failed"
+	}
+	names := strings.Join(counts.failedNames, "\n")
+	if counts.failed > len(counts.failedNames) {
+		names += fmt.Sprintf("\nand %d more", counts.failed-len(counts.failedNames))
+	}
+	reportBuildProblem(w, "", description+"\n"+names)
+}
+
+// List the tests that took longer than MaxTestDuration, to see them all in one place, failed for it or not
+func (counts *testCounts) reportSlow(w io.Writer, opts Options) {
+	if len(counts.slow) == 0 {
+		return
+	}
+	text := fmt.Sprintf("%d tests took longer than %dms:\n", len(counts.slow), opts.milliseconds(opts.MaxTestDuration))
+	if len(counts.slow) == 1 {
+		text = fmt.Sprintf("1 test took longer than %dms:\n", opts.milliseconds(opts.MaxTestDuration))
+	}
+	text += strings.Join(counts.slow, "\n")
+	fmt.Fprintf(w, "##teamcity[message text='%s' status='WARNING']\n", Escape(text))
+}
+
+// Warn if the tool that ran the tests tallied them differently in its summary, which means we've lost track of some
+// It goes to w rather than in with the service messages, since it's about us rather than the tests
+func (counts *testCounts) check(w io.Writer, summary string) {
+	match := testSummaryPattern.FindStringSubmatch(summary)
+	if match == nil {
+		return
+	}
+	total, _ := strconv.Atoi(match[1])
+	failed, skipped := 0, 0
+	for _, count := range summaryCountPattern.FindAllStringSubmatch(match[2], -1) {
+		n, _ := strconv.Atoi(count[1])
+		switch strings.TrimSuffix(count[2], "s") {
+		case "failure":
+			failed = n
+		case "skipped":
+			skipped = n
+		}
+	}
+	if total != counts.ran || failed != counts.ranFailed || skipped != counts.ranSkipped {
+		fmt.Fprintf(w, "The summary counts %d tests, %d failed and %d skipped, but we found %d, %d and %d\n",
+			total, failed, skipped, counts.ran, counts.ranFailed, counts.ranSkipped)
+	}
+}
+
+// go vet's findings, for TeamCity's inspections tab, where they're all of the one type
+type inspections struct {
+	// Whether that type has been described yet
+	described bool
+	// By file, line and message, so the same finding (as from running go vet before go test, which runs it again)
+	// is only reported the once
+	seen map[[3]string]bool
+}
+
+func (inspections *inspections) report(w io.Writer, line string) {
+	match := vetPattern.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	file := strings.TrimPrefix(match[1], "./")
+	key := [3]string{file, match[2], match[3]}
+	if inspections.seen[key] {
+		return
+	}
+	if inspections.seen == nil {
+		inspections.seen = map[[3]string]bool{}
+	}
+	inspections.seen[key] = true
+	if !inspections.described {
+		fmt.Fprintln(w, "##teamcity[inspectionType id='go-vet' name='go vet' description='Reported by go vet' category='go vet']")
+		inspections.described = true
+	}
+	fmt.Fprintf(w, "##teamcity[inspection typeId='go-vet' message='%s' file='%s' line='%s' SEVERITY='WARNING']\n",
+		Escape(match[3]), Escape(file), match[2])
+}
+
+// Output from before any of a package's tests ran, e.g. TestMain setting up, is kept together at the start of its suite
+func reportSetupOutput(w io.Writer, pkg string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	name := pkg + " setup"
+	fmt.Fprintf(w, "##teamcity[blockOpened name='%s']\n", Escape(name))
+	printLines(w, lines)
+	fmt.Fprintf(w, "##teamcity[blockClosed name='%s']\n", Escape(name))
+}
+
+func printLines(w io.Writer, lines []string) {
+	for _, line := range lines {
+		fmt.Fprintln(w, defang(line))
+	}
+}
+
+// The description starts with the package responsible, if we know it, so it's obvious at a glance
+// Its first line with the package is the problem's identity, so TeamCity sees the same problem in each build as one
+func reportBuildProblem(w io.Writer, pkg string, description string) {
+	if pkg != "" {
+		description = pkg + ": " + description
+	}
+	hash := fnv.New64a()
+	io.WriteString(hash, strings.SplitN(description, "\n", 2)[0])
+	fmt.Fprintf(w, "##teamcity[buildProblem description='%s' identity='%x']\n", Escape(description), hash.Sum64())
+}
+
+func reportBuildFailure(w io.Writer, pkg string, diagnostics []string) {
+	reportBuildProblem(w, pkg, strings.Join(append([]string{"failed to build"}, diagnostics...), "\n"))
+}
+
+// Each benchmark metric (ns/op, B/op, ...) becomes a statistic that TeamCity can chart across builds
+// Sub-benchmarks are keyed by their full name, e.g. BenchmarkFoo/case.ns_op
+// procs is the GOMAXPROCS suffix of each benchmark's first result, and its results for any other -cpu are named
+// with theirs, e.g. BenchmarkFoo-2, so they don't all go to the same statistics
+func reportBenchmark(w io.Writer, match []string, known map[string]bool, procs map[string]string) Benchmark {
+	benchmark := Benchmark{Name: benchmarkName(match, known), Metrics: map[string]float64{}}
+	if benchmark.Name == match[1] {
+		if first, ok := procs[benchmark.Name]; !ok {
+			procs[benchmark.Name] = match[2]
+		} else if first != match[2] {
+			benchmark.Name += match[2]
+		}
+	}
+	// The patterns only match digits, so these always parse
+	benchmark.Iterations, _ = strconv.Atoi(match[3])
+	for _, metric := range benchmarkMetricPattern.FindAllStringSubmatch(match[4], -1) {
+		reportStatistic(w, benchmark.Name+"."+metric[2], metric[1])
+		benchmark.Metrics[metric[2]], _ = strconv.ParseFloat(metric[1], 64)
+	}
+	return benchmark
+}
+
+// With BenchmarkBaseline, point out each benchmark that allocates more than it used to, by more than
+// BenchmarkThreshold, going by the average of every run of it. Returns whether any did
+func (opts Options) compareBenchmarks(w io.Writer, pkg string, benchmarks []Benchmark) bool {
+	if opts.BenchmarkBaseline == nil {
+		return false
+	}
+	current := &Report{Packages: []Package{{Name: pkg, Benchmarks: benchmarks}}}
+	compared := map[string]bool{}
+	regressed := false
+	for _, benchmark := range benchmarks {
+		if compared[benchmark.Name] {
+			continue
+		}
+		compared[benchmark.Name] = true
+		for _, unit := range []string{"B/op", "allocs/op"} {
+			before, ok := opts.BenchmarkBaseline.benchmarkMetric(pkg, benchmark.Name, unit)
+			if !ok {
+				continue
+			}
+			// From none at all, any is too many
+			if now, _ := current.benchmarkMetric(pkg, benchmark.Name, unit); now > before*(1+opts.BenchmarkThreshold/100) {
+				regressed = true
+				reportBuildProblem(w, pkg, fmt.Sprintf("%s regressed in %s\nfrom %g to %g, more than the %g%% allowed",
+					benchmark.Name, unit, before, now, opts.BenchmarkThreshold))
+			}
+		}
+	}
+	return regressed
+}
+
+func reportStatistic(w io.Writer, key string, value string) {
+	fmt.Fprintf(w, "##teamcity[buildStatisticValue key='%s' value='%s']\n", sanitizeKey(key), Escape(value))
+}
+
+// TeamCity drops statistics whose keys have anything but letters, digits, dots, dashes and underscores in them,
+// which benchmark names (BenchmarkFoo/case=1) and units (ns/op) easily do
+func sanitizeKey(key string) string {
+	return disallowedKeyCharsPattern.ReplaceAllString(key, "_")
+}
+
+// match[2] is the GOMAXPROCS suffix, which would only split the history of the same benchmark
+// But it looks just like the end of a sub-benchmark such as BenchmarkFoo/case-1 when GOMAXPROCS is 1 and there's
+// no suffix at all, so it's kept when we know a benchmark by that name
+func benchmarkName(match []string, known map[string]bool) string {
+	if known[match[1]+match[2]] {
+		return match[1] + match[2]
+	}
+	return match[1]
+}
@@ -0,0 +1,519 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+package teamcity
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// Run `go test ./teamcity -update` to rewrite the golden files after changing what's written on purpose
+var update = flag.Bool("update", false, "rewrite the golden files in testdata with what's written now")
+
+// Converts testdata/<name>.txt, the real output of go test (or Ginkgo), and compares what's written with
+// testdata/<name>.golden
+func checkGolden(t *testing.T, name string, convert func(io.Reader, io.Writer, Options) error, wantErr error) {
+	t.Helper()
+	input, err := os.Open(filepath.Join("testdata", name+".txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	var output bytes.Buffer
+	if err := convert(input, &output, DefaultOptions()); err != wantErr {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(golden, output.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), want) {
+		t.Errorf("output differs from %s:\n%s", golden, output.String())
+	}
+}
+
+// The contents of a file in testdata
+func testdata(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// The outline TreeHandler writes for what parse finds in input, to check the names and nesting of suites and tests
+func outline(t *testing.T, parse func(io.Reader, func(Event), Options) error, input string, opts Options) string {
+	t.Helper()
+	var output bytes.Buffer
+	if err := parse(strings.NewReader(input), TreeHandler(&output), opts); err != nil {
+		t.Fatal(err)
+	}
+	return output.String()
+}
+
+// What convert writes for input, whether or not any of the tests failed
+func converted(t *testing.T, convert func(io.Reader, io.Writer, Options) error, input string, opts Options) string {
+	t.Helper()
+	var output bytes.Buffer
+	if err := convert(strings.NewReader(input), &output, opts); err != nil && err != ErrTestsFailed {
+		t.Fatal(err)
+	}
+	return output.String()
+}
+
+func checkOutline(t *testing.T, got string, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got outline:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	for _, c := range []struct {
+		name, input, want string
+	}{
+		{"ascii", "TestFoo", "TestFoo"},
+		{"specials", "it's [a|b]\n", "it|'s|0x0020|[a||b|]|n"},
+		{"latin", "café", "caf|0x00e9"},
+		{"japanese", "テスト", "|0x30c6|0x30b9|0x30c8"},
+		{"emoji", "😀", "|0xd83d|0xde00"},
+		{"mixed", "é テ 😀", "|0x00e9|0x0020|0x30c6|0x0020|0xd83d|0xde00"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Escape(c.input); got != c.want {
+				t.Errorf("Escape(%q) = %q, want %q", c.input, got, c.want)
+			}
+		})
+	}
+}
+
+// Decodes Escape's |0xXXXX sequences back as TeamCity does, taking each as a UTF-16 code unit, so a surrogate pair
+// only comes out as its character if both halves are there and in order
+var codeUnitPattern = regexp.MustCompile(`(?:\|0x[0-9a-f]{4})+`)
+
+func unescapeCodeUnits(escaped string) string {
+	return codeUnitPattern.ReplaceAllStringFunc(escaped, func(units string) string {
+		var decoded []uint16
+		for i := 0; i < len(units); i += len("|0x0000") {
+			unit, _ := strconv.ParseUint(units[i+len("|0x"):i+len("|0x0000")], 16, 16)
+			decoded = append(decoded, uint16(unit))
+		}
+		return string(utf16.Decode(decoded))
+	})
+}
+
+func TestEscapeSurrogatePairsRoundTrip(t *testing.T) {
+	for _, input := range []string{"😀", "a😀b", "🇬🇧 flags", "𝄞 music", "mixed é, テ and 😀😀"} {
+		escaped := Escape(input)
+		if got := unescapeCodeUnits(escaped); got != input {
+			t.Errorf("Escape(%q) = %q, which decodes to %q", input, escaped, got)
+		}
+	}
+}
+
+// A failing benchmark is reported as a test, with what it printed, whether or not the rest are, and in text output
+// it has no `=== RUN`, with -v or without
+func TestParseBenchmarks(t *testing.T) {
+	asTests := DefaultOptions()
+	asTests.Strict = true
+	asTests.BenchmarksAsTests = true
+	onlyFailures := asTests
+	onlyFailures.BenchmarksAsTests = false
+	for _, c := range []struct {
+		name  string
+		parse func(io.Reader, func(Event), Options) error
+		opts  Options
+		want  string
+	}{
+		{"bench.txt", Parse, onlyFailures, `example.com/fix/bench
+  PASS TestOK (0.00s)
+  FAIL BenchmarkBad (0.00s, 22 bytes of output): b_test.go:13: nope
+`},
+		{"benchquiet.txt", Parse, onlyFailures, `example.com/fix/bench
+  FAIL BenchmarkBad (0.00s, 22 bytes of output): b_test.go:13: nope
+`},
+		{"bench.json", ParseJSON, onlyFailures, `example.com/fix/bench
+  PASS TestOK (0.00s)
+  FAIL BenchmarkBad (0.00s, 22 bytes of output): b_test.go:13: nope
+`},
+		{"bench.txt", Parse, asTests, `example.com/fix/bench
+  PASS TestOK (0.00s)
+  PASS BenchmarkGood (0.00s)
+  FAIL BenchmarkBad (0.00s, 22 bytes of output): b_test.go:13: nope
+  PASS BenchmarkTop (0.00s)
+  BenchmarkTop
+    PASS sub (0.00s)
+`},
+		{"bench.json", ParseJSON, asTests, `example.com/fix/bench
+  PASS TestOK (0.00s)
+  PASS BenchmarkGood (0.00s)
+  FAIL BenchmarkBad (0.00s, 22 bytes of output): b_test.go:13: nope
+  PASS BenchmarkTop (0.00s)
+  BenchmarkTop
+    PASS sub (0.00s)
+`},
+		// Its duration is how long it ran for, not just its last run of b.N iterations
+		{"benchlong.json", ParseJSON, asTests, `example.com/fix/bench
+  PASS BenchmarkGood (0.61s)
+`},
+	} {
+		t.Run(fmt.Sprintf("%s/as-tests=%v", c.name, c.opts.BenchmarksAsTests), func(t *testing.T) {
+			checkOutline(t, outline(t, c.parse, testdata(t, c.name), c.opts), c.want)
+		})
+	}
+}
+
+// Sub-benchmarks nest under their parent like subtests do, and with -cpu 1,2 the results for each GOMAXPROCS are
+// statistics of their own
+func TestConvertSubBenchmarks(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		parse   func(io.Reader, func(Event), Options) error
+		convert func(io.Reader, io.Writer, Options) error
+	}{
+		{"subbench.txt", Parse, Convert},
+		{"subbench.json", ParseJSON, ConvertJSON},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			input := testdata(t, c.name)
+			got := outline(t, c.parse, input, DefaultOptions())
+			if !strings.Contains(got, "\n  BenchmarkCases\n    FAIL broken (") {
+				t.Errorf("the failing sub-benchmark isn't in its parent's suite:\n%s", got)
+			}
+			output := converted(t, c.convert, input, DefaultOptions())
+			for _, key := range []string{"BenchmarkCases_fast-path.ns_op", "BenchmarkCases_fast-path-2.ns_op"} {
+				if strings.Count(output, "key='"+key+"'") != 1 {
+					t.Errorf("want one %s statistic:\n%s", key, output)
+				}
+			}
+		})
+	}
+}
+
+// A package that fails after its tests pass gets a TestMain that failed, whose message is everything the package
+// printed, not just its first line and not the benchmarks' machine info
+func TestParseTestMainFailure(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		parse func(io.Reader, func(Event), Options) error
+	}{
+		{"testmain.txt", Parse},
+		{"testmain.json", ParseJSON},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var testMain *TestFinished
+			handle := func(event Event) {
+				if finished, ok := event.(TestFinished); ok && finished.Name == "TestMain" {
+					testMain = &finished
+				}
+			}
+			if err := c.parse(strings.NewReader(testdata(t, c.name)), handle, DefaultOptions()); err != nil {
+				t.Fatal(err)
+			}
+			if testMain == nil {
+				t.Fatal("no TestMain was reported")
+			}
+			if want := "setting up db\nleak detected: goroutine 7"; testMain.Status != "FAIL" || testMain.Message != want {
+				t.Errorf("got TestMain %s with message %q, want FAIL with %q", testMain.Status, testMain.Message, want)
+			}
+		})
+	}
+}
+
+// With Strict, what ends up as TestMain's output isn't unrecognised, but the same line passed through on its own is
+func TestParseStrict(t *testing.T) {
+	strict := DefaultOptions()
+	strict.Strict = true
+	for _, c := range []struct {
+		name  string
+		parse func(io.Reader, func(Event), Options) error
+		input string
+		want  []string
+	}{
+		{"testmain.txt", Parse, testdata(t, "testmain.txt"), nil},
+		{"testmain.json", ParseJSON, testdata(t, "testmain.json"), nil},
+		{"stray text", Parse, "=== RUN   TestA\n--- PASS: TestA (0.00s)\nstray line\nPASS\nok  \tex\t0.1s\n", []string{"stray line"}},
+		{"stray json", ParseJSON, `{"Action":"run","Package":"ex","Test":"TestA"}
+{"Action":"pass","Package":"ex","Test":"TestA"}
+{"Action":"output","Package":"ex","Output":"stray line\n"}
+{"Action":"pass","Package":"ex"}
+`, []string{"stray line"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.parse(strings.NewReader(c.input), func(Event) {}, strict)
+			var got []string
+			if unrecognized, ok := err.(*UnrecognizedError); ok {
+				got = unrecognized.Lines
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("got unrecognised lines %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// Two packages run at once with -p 2: go test -v holds each one's output until it finishes, so a package's tests all
+// come before the next's and the one buffer in Parse is enough, whereas with -json their events are interleaved
+func TestParseParallelPackages(t *testing.T) {
+	want := `example.com/fix/left
+  PASS TestLeftOne (0.12s)
+  FAIL TestLeftTwo (0.04s, 35 bytes of output): left_test.go:17: left two broke
+example.com/fix/right
+  PASS TestRightOne (0.12s)
+  PASS TestRightTwo (0.04s)
+`
+	for _, c := range []struct {
+		name  string
+		parse func(io.Reader, func(Event), Options) error
+	}{
+		{"twopackages.txt", Parse},
+		{"twopackages.json", ParseJSON},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			checkOutline(t, outline(t, c.parse, testdata(t, c.name), DefaultOptions()), want)
+		})
+	}
+	// Which only shows anything if they really are
+	events := testdata(t, "twopackages.json")
+	if strings.Index(events, `"Package":"example.com/fix/right","Test":"TestRightOne"`) > strings.Index(events, `"Action":"pass","Package":"example.com/fix/left","Test":"TestLeftOne"`) {
+		t.Error("the packages' events in twopackages.json aren't interleaved")
+	}
+}
+
+func TestConvertMutedSubtest(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Muted = regexp.MustCompile(`^TestP/flaky$`)
+	want := `ex
+  SKIP TestP (0.00s): Muted flaky test: subtest flaky failed
+  TestP
+    SKIP flaky (0.00s, 23 bytes of output): Muted flaky test: p_test.go:5: flaked
+    PASS fine (0.00s)
+`
+	for _, c := range []struct {
+		name    string
+		parse   func(io.Reader, func(Event), Options) error
+		convert func(io.Reader, io.Writer, Options) error
+		input   string
+	}{
+		{"text", Parse, Convert, "=== RUN   TestP\n=== RUN   TestP/flaky\n    p_test.go:5: flaked\n=== RUN   TestP/fine\n--- FAIL: TestP (0.00s)\n    --- FAIL: TestP/flaky (0.00s)\n    --- PASS: TestP/fine (0.00s)\nFAIL\nFAIL\tex\t0.1s\n"},
+		{"json", ParseJSON, ConvertJSON, `{"Action":"run","Package":"ex","Test":"TestP"}
+{"Action":"run","Package":"ex","Test":"TestP/flaky"}
+{"Action":"output","Package":"ex","Test":"TestP/flaky","Output":"    p_test.go:5: flaked\n"}
+{"Action":"fail","Package":"ex","Test":"TestP/flaky","Elapsed":0}
+{"Action":"run","Package":"ex","Test":"TestP/fine"}
+{"Action":"pass","Package":"ex","Test":"TestP/fine","Elapsed":0}
+{"Action":"fail","Package":"ex","Test":"TestP","Elapsed":0}
+{"Action":"fail","Package":"ex","Elapsed":0.1}
+`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			checkOutline(t, outline(t, c.parse, c.input, opts), want)
+			// Nor does the build fail for it
+			if err := c.convert(strings.NewReader(c.input), io.Discard, opts); err != nil {
+				t.Errorf("got %v, want the muted failure not to fail the build", err)
+			}
+		})
+	}
+}
+
+func TestConvertDefangsPassedThroughOutput(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		convert func(io.Reader, io.Writer, Options) error
+		input   string
+	}{
+		{"text", Convert, "setting up ##teamcity[buildStatus text='setup']\n=== RUN   TestA\n    a_test.go:5: ##teamcity[buildStatus text='log']\n--- PASS: TestA (0.00s)\n##teamcity[buildStatus text='stray']\nPASS\nok  \tex\t0.1s\n"},
+		{"json", ConvertJSON, `{"Action":"output","Package":"ex","Output":"setting up ##teamcity[buildStatus text='setup']\n"}
+{"Action":"run","Package":"ex","Test":"TestA"}
+{"Action":"output","Package":"ex","Test":"TestA","Output":"    a_test.go:5: ##teamcity[buildStatus text='log']\n"}
+{"Action":"pass","Package":"ex","Test":"TestA","Elapsed":0}
+{"Action":"output","Package":"ex","Output":"##teamcity[buildStatus text='stray']\n"}
+{"Action":"pass","Package":"ex","Elapsed":0.1}
+##teamcity[buildStatus text='not json']
+`},
+		{"ginkgo", ConvertGinkgo, "Running Suite: Books Suite - /tmp/gk\n##teamcity[buildStatus text='stray']\nRan 0 of 0 Specs in 0.001 seconds\n"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			output := converted(t, c.convert, c.input, DefaultOptions())
+			if strings.Contains(output, "##teamcity[buildStatus") {
+				t.Errorf("a service message in the tests' output was passed through as one:\n%s", output)
+			}
+			if want := strings.Count(c.input, "##teamcity[buildStatus"); strings.Count(output, "##teamcity|[buildStatus") != want {
+				t.Errorf("got output:\n%s\nwant all %d of the tests' service messages in it, defanged", output, want)
+			}
+		})
+	}
+}
+
+// Output saved by some Windows tools starts with a byte order mark, which mustn't stop the first line being read
+func TestParseByteOrderMark(t *testing.T) {
+	// Strictly, so the first line not being recognised with the mark still in front of it is an error
+	opts := DefaultOptions()
+	opts.Strict = true
+	for _, c := range []struct {
+		name  string
+		parse func(io.Reader, func(Event), Options) error
+	}{
+		{"text.txt", Parse},
+		{"json.txt", ParseJSON},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			input := testdata(t, c.name)
+			got := outline(t, c.parse, "\ufeff"+input, opts)
+			checkOutline(t, got, outline(t, c.parse, input, opts))
+			if !strings.Contains(got, "PASS TestAdd") {
+				t.Errorf("the first test, TestAdd, is missing:\n%s", got)
+			}
+		})
+	}
+}
+
+// Output saved on Windows ends its lines with \r\n, and none of the \r must end up in names or output
+// With -json the \r is outside of each event rather than in its Output
+func TestConvertCRLF(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Strict = true
+	for _, c := range []struct {
+		name    string
+		parse   func(io.Reader, func(Event), Options) error
+		convert func(io.Reader, io.Writer, Options) error
+	}{
+		{"text.txt", Parse, Convert},
+		{"json.txt", ParseJSON, ConvertJSON},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			input := testdata(t, c.name)
+			crlf := strings.Replace(input, "\n", "\r\n", -1)
+			checkOutline(t, outline(t, c.parse, crlf, opts), outline(t, c.parse, input, opts))
+			var output strings.Builder
+			if err := c.convert(strings.NewReader(crlf), &output, opts); err != ErrTestsFailed {
+				t.Errorf("got error %v, want %v", err, ErrTestsFailed)
+			}
+			if strings.Contains(output.String(), "\r") || strings.Contains(output.String(), "|r") {
+				t.Errorf("a carriage return was left in:\n%q", output.String())
+			}
+		})
+	}
+}
+
+// t.Run("has spaces") is printed as has_spaces, but a name with the spaces left in must be read whole too
+func TestParseNamesWithSpaces(t *testing.T) {
+	want := `example.com/fix/spaces
+  FAIL TestNames (0.00s): subtest fails_with_spaces failed
+  TestNames
+    PASS has_spaces (0.00s)
+    FAIL fails_with_spaces (0.00s, 32 bytes of output): spaces_test.go:8: spaced out
+`
+	spaced := strings.NewReplacer("has_spaces", "has spaces", "fails_with_spaces", "fails with spaces")
+	for _, c := range []struct {
+		name  string
+		parse func(io.Reader, func(Event), Options) error
+	}{
+		{"spaces.txt", Parse},
+		{"spaces.json", ParseJSON},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			input := testdata(t, c.name)
+			checkOutline(t, outline(t, c.parse, input, DefaultOptions()), want)
+			checkOutline(t, outline(t, c.parse, spaced.Replace(input), DefaultOptions()), spaced.Replace(want))
+		})
+	}
+}
+
+// With Blocks, everything written for a package is in one block of its own, even where packages' events are interleaved
+func TestConvertBlocks(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Blocks = true
+	for _, c := range []struct {
+		name    string
+		convert func(io.Reader, io.Writer, Options) error
+	}{
+		{"twopackages.txt", Convert},
+		{"twopackages.json", ConvertJSON},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			output := converted(t, c.convert, testdata(t, c.name), opts)
+			blockPattern := regexp.MustCompile(`^##teamcity\[block(Opened|Closed) name='([^']*)'\]$`)
+			flowPattern := regexp.MustCompile(`flowId='([^']*)'`)
+			block := ""
+			blocks := map[string]int{}
+			for _, line := range strings.Split(output, "\n") {
+				if match := blockPattern.FindStringSubmatch(line); match == nil {
+					if match := flowPattern.FindStringSubmatch(line); match != nil && match[1] != block {
+						t.Errorf("%s is in the block for %q", line, block)
+					}
+				} else if match[1] == "Opened" {
+					if block != "" {
+						t.Errorf("the block for %s is opened inside the one for %s", match[2], block)
+					}
+					block = match[2]
+					blocks[block]++
+				} else {
+					if match[2] != block {
+						t.Errorf("the block for %s is closed inside the one for %q", match[2], block)
+					}
+					block = ""
+				}
+			}
+			if want := map[string]int{"example.com/fix/left": 1, "example.com/fix/right": 1}; fmt.Sprint(blocks) != fmt.Sprint(want) {
+				t.Errorf("got blocks %v, want %v", blocks, want)
+			}
+			// As is what's passed through as it is, which has no flowId to go by
+			logged := strings.Index(output, "left one 0")
+			if logged < strings.Index(output, "##teamcity[blockOpened name='example.com/fix/left']") || logged > strings.Index(output, "##teamcity[blockClosed name='example.com/fix/left']") {
+				t.Errorf("TestLeftOne's logs aren't in the block for its package:\n%s", output)
+			}
+		})
+	}
+}
+
+// With Sort, packages and the tests in them are reported by name, not in the order they finished
+func TestParseSort(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Sort = true
+	want := `ex/a
+  PASS TestY (0.00s)
+ex/b
+  PASS TestA (0.00s)
+  PASS TestZ (0.00s)
+`
+	for _, c := range []struct {
+		name  string
+		parse func(io.Reader, func(Event), Options) error
+		input string
+	}{
+		{"text", Parse, "=== RUN   TestZ\n--- PASS: TestZ (0.00s)\n=== RUN   TestA\n--- PASS: TestA (0.00s)\nPASS\nok  \tex/b\t0.1s\n=== RUN   TestY\n--- PASS: TestY (0.00s)\nPASS\nok  \tex/a\t0.1s\n"},
+		{"json", ParseJSON, `{"Action":"run","Package":"ex/b","Test":"TestZ"}
+{"Action":"pass","Package":"ex/b","Test":"TestZ","Elapsed":0}
+{"Action":"run","Package":"ex/b","Test":"TestA"}
+{"Action":"pass","Package":"ex/b","Test":"TestA","Elapsed":0}
+{"Action":"pass","Package":"ex/b","Elapsed":0.1}
+{"Action":"run","Package":"ex/a","Test":"TestY"}
+{"Action":"pass","Package":"ex/a","Test":"TestY","Elapsed":0}
+{"Action":"pass","Package":"ex/a","Elapsed":0.1}
+`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			checkOutline(t, outline(t, c.parse, c.input, opts), want)
+		})
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+package teamcity
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// What the suite is called when the output ends partway through a package
+const incompletePackageName = "(incomplete)"
+
+// Convert reads the output of `go test -v` and writes it back out as TeamCity service messages, or whatever opts.Format says
+func Convert(r io.Reader, output io.Writer, opts Options) error {
+	w := opts.messageWriter(output)
+	report, failed, err := convert(r, w, TeamCityHandler(w, opts), opts)
+	return opts.finishConversion(output, report, failed, err)
+}
+
+// Parse reads the output of `go test -v`, calling handler with each suite and test it finds
+// Anything else in the input, like build failures and benchmarks, is dropped
+func Parse(r io.Reader, handler func(Event), opts Options) error {
+	_, _, err := convert(r, io.Discard, handler, opts)
+	return err
+}
+
+// Anything we write ourselves goes to w, whereas the suites and tests go to handle
+func convert(r io.Reader, w io.Writer, handle func(Event), opts Options) (*Report, bool, error) {
+	scanner := opts.newScanner(r)
+	handle, flushSorted := opts.sortEvents(handle)
+	// There's only ever the one package at a time, so only the one block
+	block := &packageBlock{w: w, blocks: opts.Blocks}
+	w = block
+	// We hold onto the test results for a package until it completes, so we can properly output it as a suite
+	// Unlike with -json, we don't know which package a test belongs to until then, so there's only the one buffer
+	// That's enough, since go test never interleaves the text output of packages: when it's running more than
+	// one at once (-p), it holds on to each one's output until it finishes, whether or not that's with -v
+	packageTestBuffer := []*TestResult{}
+	// We explicitly capture test output only upon failure (or with -capture-pass), otherwise it is passed through immediately.
+	var capturingTest *TestResult
+	// The test that most recently started or continued, so most likely the one running
+	var activeTest *TestResult
+	// Whichever test whatever just happened is most likely to be about
+	blame := func() *TestResult {
+		if capturingTest != nil {
+			return capturingTest
+		}
+		if activeTest != nil && activeTest.Status == "" {
+			return activeTest
+		}
+		return findRunningTest(packageTestBuffer)
+	}
+	// Whether output would be captured to a test that's still running, which could print anything, even a line that
+	// looks like the test binary's verdict
+	capturingRunning := func() bool {
+		test := capturingTest
+		if test == nil {
+			test = activeTest
+		}
+		return test != nil && test.Finished.IsZero()
+	}
+	// The test that finished on the line before, if it passed, whose logs may follow
+	var loggingTest *TestResult
+	// We only complain about a missing -v the once
+	warnedNotVerbose := false
+	// Or about JSON input
+	warnedJSON := false
+	// Output from before the current package's first test, which we hold onto until we know which package that is
+	var setupOutput []string
+	// Output from outside of any test since, which we hold onto in case it's why the package failed
+	var trailingOutput []string
+	// Compiler output since the last package finished, in case that package turns out to have failed to build
+	var diagnostics []string
+	// The race detector report currently being read, if any
+	var raceReport []string
+	coverage := coverageStats{}
+	// The current package's coverage, from the line of its own that comes before its finish line, which only repeats
+	// it if the package passed
+	packageCoverage := ""
+	inspections := inspections{}
+	// The benchmarks we've seen start, to tell their names apart from the GOMAXPROCS suffix on their results
+	benchmarks := map[string]bool{}
+	// And the GOMAXPROCS of each one's first result, see reportBenchmark
+	benchmarkProcs := map[string]string{}
+	// The results of those benchmarks, which are the package's but only known to be once it finishes
+	var packageBenchmarks []Benchmark
+	names := packageNames{}
+	counts := testCounts{}
+	// The summary that ends the output, if whatever ran the tests wrote one
+	summary := ""
+	report := &Report{}
+	// Lines we have no idea about, for opts.Strict
+	unrecognized := &UnrecognizedError{strict: opts.Strict}
+	// Whether anything at all failed
+	failed := false
+	for scanner.Scan() {
+		input := scanner.Text()
+		if opts.StripANSI {
+			input = ansiPattern.ReplaceAllString(input, "")
+		}
+		finishedTest := loggingTest
+		loggingTest = nil
+
+		if raceReport != nil || raceDelimiterPattern.MatchString(input) {
+			raceReport = append(raceReport, input)
+			if len(raceReport) > 1 && raceDelimiterPattern.MatchString(input) {
+				// That's the end of the report, which is about whatever test is running
+				test := blame()
+				if test == nil {
+					failed = true
+					reportBuildProblem(w, "", dataRaceMessage)
+					fmt.Fprintln(w, defang(strings.Join(raceReport, "\n")))
+				} else {
+					test.Status = "FAIL"
+					test.Message = dataRaceMessage
+					test.raced = true
+					for _, line := range raceReport {
+						test.appendOutput(line, true)
+					}
+					capturingTest = test
+				}
+				raceReport = nil
+			}
+		} else if cruftPattern.MatchString(input) && !(verdictPattern.MatchString(input) && capturingRunning()) {
+			// Some stuff we just want to drop
+		} else if match := testRunPattern.FindStringSubmatch(input); match != nil {
+			capturingTest = nil
+			activeTest = &TestResult{Name: match[1], Started: time.Now()}
+			packageTestBuffer = append(packageTestBuffer, activeTest)
+		} else if match := testFinishPattern.FindStringSubmatch(input); match != nil && !hasFinished(match[2], packageTestBuffer) {
+			test := findTest(match[2], packageTestBuffer)
+			if test == nil {
+				// Without -v there are no `=== RUN` lines, and only failures get this far, so make do with what we have
+				// (Or the start of the output is missing, but either way it's still worth reporting)
+				// Benchmarks never have one, and without -v not even their names as they start, -v or not
+				if !warnedNotVerbose && !strings.HasPrefix(match[2], "Benchmark") {
+					fmt.Fprintln(os.Stderr, "Tests are finishing without having started, run `go test` with -v for complete results")
+					warnedNotVerbose = true
+				}
+				test = &TestResult{Name: match[2]}
+				packageTestBuffer = append(packageTestBuffer, test)
+			}
+			test.Status = match[1]
+			test.failIfRaced()
+			test.Finished = time.Now()
+			// Usually just seconds, but anything time.Duration might print
+			// Without one at all, which shouldn't happen but might if the output was mangled, it's left at 0
+			if duration, err := time.ParseDuration(match[3]); err == nil {
+				test.DurationSec = duration.Seconds()
+				if test.Started.IsZero() {
+					// It must have started about then, for -timestamps
+					test.Started = test.Finished.Add(-duration)
+				}
+			} else if match[3] != "" {
+				fmt.Fprintf(os.Stderr, "Couldn't parse the duration of %s: %v\n", test.Name, err)
+				unrecognized.add(input)
+			}
+			test.addToParent(packageTestBuffer)
+			test.release(w, opts)
+			if test.shouldCapture(opts) && opts.outputFollowsFinish() {
+				// Before Go 1.14, failure output proceeds a test failure header
+				capturingTest = test
+			} else {
+				// Whatever was being captured is over either way, a parallel test passing straight after a failure
+				// doesn't mean what follows is still the failure's
+				capturingTest = nil
+				if opts.outputFollowsFinish() {
+					loggingTest = test
+				}
+			}
+		} else if testPausePattern.MatchString(input) {
+			// Whatever comes next belongs to some other test
+			capturingTest = nil
+			activeTest = nil
+		} else if match := testContinuePattern.FindStringSubmatch(input); match != nil {
+			// Parallel tests take turns, so go back to capturing for whichever one is now running
+			capturingTest = nil
+			activeTest = findTest(match[1], packageTestBuffer)
+			if activeTest != nil && activeTest.shouldCapture(opts) {
+				capturingTest = activeTest
+			}
+		} else if match := testNamePattern.FindStringSubmatch(input); match != nil {
+			// Same again, but this is just output changing hands rather than tests taking turns
+			capturingTest = nil
+			activeTest = findTest(match[1], packageTestBuffer)
+			if activeTest != nil && activeTest.shouldCapture(opts) {
+				capturingTest = activeTest
+			}
+		} else if match := buildFailedPattern.FindStringSubmatch(input); match != nil {
+			capturingTest = nil
+			failed = true
+			pkg := names.unique(match[1])
+			block.open(pkg)
+			unrecognized.addLines(setupOutput)
+			unrecognized.addLines(trailingOutput)
+			printLines(w, setupOutput)
+			printLines(w, trailingOutput)
+			reportBuildFailure(w, pkg, diagnostics)
+			block.close(pkg)
+			report.addBuildFailure(pkg, diagnostics)
+			packageBenchmarks = nil
+			setupOutput = nil
+			trailingOutput = nil
+			diagnostics = nil
+			activeTest = nil
+			packageTestBuffer = []*TestResult{}
+		} else if match := matchPackageFinish(input); match != nil {
+			capturingTest = nil
+			passBenchmarks(packageTestBuffer)
+			packageTestBuffer = opts.reportedBenchmarks(packageTestBuffer)
+			if (match[1] == "FAIL" && !opts.anyMuted(packageTestBuffer)) || opts.anyFailed(packageTestBuffer) {
+				failed = true
+			}
+			pkg := names.unique(match[2])
+			// A package without test files that didn't print anything either has nothing to show, not even a block
+			// of its own, otherwise a tree split into many small packages is mostly empty blocks
+			untested := match[1] == "?" && len(packageTestBuffer) == 0 && len(setupOutput) == 0 && block.empty()
+			if !untested || opts.ShowUntested {
+				block.open(pkg)
+			}
+			if match[1] == "FAIL" {
+				if test := opts.packageFailure(packageTestBuffer, append(setupOutput, trailingOutput...)); test != nil {
+					packageTestBuffer = append(packageTestBuffer, test)
+					setupOutput = nil
+					trailingOutput = nil
+				}
+			}
+			// Flush package results, unless there's nothing to report at all ("?" is for [no test files])
+			if match[1] != "?" {
+				reportSetupOutput(w, pkg, setupOutput)
+				unrecognized.addLines(trailingOutput)
+				printLines(w, trailingOutput)
+				opts.flushPackage(handle, pkg, packageTestBuffer)
+				counts.add(pkg, packageTestBuffer, opts)
+				report.add(pkg, packageDuration(match[3]), packageTestBuffer, packageBenchmarks, opts)
+				if opts.compareBenchmarks(w, pkg, packageBenchmarks) {
+					failed = true
+				}
+			} else {
+				// Which wasn't them, then
+				unrecognized.addLines(setupOutput)
+				printLines(w, setupOutput)
+				if opts.ShowUntested {
+					opts.reportUntested(handle, pkg)
+				}
+			}
+			if isCached(match[3]) {
+				reportCached(w, match[2])
+			}
+			if noTestsRun(match[3]) {
+				reportNoTestsRun(w, match[2])
+			}
+			reportPackageDuration(w, match[2], packageDuration(match[3]))
+			if packageCoverage != "" {
+				coverage.report(w, match[2], packageCoverage)
+			} else {
+				coverage.report(w, match[2], match[3])
+			}
+			packageCoverage = ""
+			if !untested || opts.ShowUntested {
+				block.close(pkg)
+			}
+			packageBenchmarks = nil
+			setupOutput = nil
+			trailingOutput = nil
+			diagnostics = nil
+			activeTest = nil
+			packageTestBuffer = []*TestResult{}
+		} else if panicPattern.MatchString(input) {
+			// A panic takes down the whole test binary, so `--- FAIL` may never arrive for the test responsible
+			test := blame()
+			if test == nil {
+				failed = true
+				// We don't know which package this is until it finishes
+				reportBuildProblem(w, "", input)
+				fmt.Fprintln(w, defang(input))
+			} else {
+				if timeoutPattern.MatchString(input) {
+					failUnfinished(packageTestBuffer, input)
+				}
+				test.Status = "FAIL"
+				test.Message = input
+				// The stack trace that follows is captured along with it
+				test.panicked = true
+				test.appendOutput(input, true)
+				capturingTest = test
+			}
+		} else if match := untestedPackagePattern.FindStringSubmatch(input); match != nil {
+			coverage.report(w, match[1], input)
+			fmt.Fprintln(w, defang(input))
+		} else if match := benchmarkHeaderPattern.FindStringSubmatch(input); match != nil {
+			capturingTest = nil
+			benchmarks[match[1]] = true
+			// Whatever it prints is held onto like a test's, in case it fails, which is the only time it's reported as
+			// one without BenchmarksAsTests
+			activeTest = &TestResult{Name: match[1], Started: time.Now()}
+			packageTestBuffer = append(packageTestBuffer, activeTest)
+			fmt.Fprintln(w, defang(input))
+		} else if match := benchmarkPattern.FindStringSubmatch(input); match != nil {
+			capturingTest = nil
+			benchmark := reportBenchmark(w, match, benchmarks, benchmarkProcs)
+			packageBenchmarks = append(packageBenchmarks, benchmark)
+			passBenchmark(w, packageTestBuffer, benchmark, time.Now(), opts)
+			fmt.Fprintln(w, defang(input))
+		} else if coveragePattern.MatchString(input) {
+			// It's the package's, even straight after a failing test whose output would otherwise follow
+			packageCoverage = input
+			fmt.Fprintln(w, defang(input))
+		} else if benchmarkInfoPattern.MatchString(input) {
+			// The machine the benchmarks that follow ran on, which is nothing to do with any test, nor why the package
+			// failed if it did
+			fmt.Fprintln(w, defang(input))
+		} else if capturingTest != nil {
+			// Capture output to the current test
+			capturingTest.appendOutput(input, false)
+		} else if activeTest != nil && activeTest.Finished.IsZero() {
+			// Since Go 1.14 output is printed as it happens, before we know whether the test failed, so hold onto it
+			activeTest.appendOutput(input, false)
+		} else if finishedTest != nil && strings.HasPrefix(input, "    ") {
+			// Before then, a passing test's logs follow its `--- PASS`, indented beneath it, so they're its rather than
+			// the package's, and go the same way as the rest of its output
+			fmt.Fprintln(w, defang(input))
+			loggingTest = finishedTest
+		} else {
+			// Who knows
+			if jsonEventPattern.MatchString(input) && !warnedJSON {
+				fmt.Fprintln(os.Stderr, "This looks like the output of `go test -json`, which needs -json to be read")
+				warnedJSON = true
+			}
+			if testSummaryPattern.MatchString(input) {
+				summary = input
+			}
+			if opts.Vet {
+				inspections.report(w, input)
+			}
+			if diagnosticPattern.MatchString(input) || (opts.Vet && vetPattern.MatchString(input)) {
+				diagnostics = append(diagnostics, input)
+				fmt.Fprintln(w, defang(input))
+			} else if len(packageTestBuffer) == 0 {
+				// Only unrecognised if it isn't reported as the package's setup or TestMain's output in the end
+				setupOutput = append(setupOutput, input)
+			} else {
+				trailingOutput = append(trailingOutput, input)
+			}
+		}
+	}
+	// Without a package finish line we never learnt which package these were from
+	unrecognized.addLines(setupOutput)
+	unrecognized.addLines(trailingOutput)
+	printLines(w, setupOutput)
+	printLines(w, trailingOutput)
+	packageTestBuffer = opts.reportedBenchmarks(packageTestBuffer)
+	if len(packageTestBuffer) > 0 || !block.empty() {
+		block.open(incompletePackageName)
+		opts.flushIncomplete(handle, incompletePackageName, packageTestBuffer)
+		block.close(incompletePackageName)
+	}
+	counts.add(incompletePackageName, packageTestBuffer, opts)
+	if len(packageTestBuffer) > 0 {
+		report.add(incompletePackageName, 0, packageTestBuffer, packageBenchmarks, opts)
+	}
+	if opts.anyFailed(packageTestBuffer) {
+		failed = true
+	}
+	flushSorted()
+	if !opts.Follow {
+		coverage.reportAverage(block.w)
+		counts.report(block.w)
+	}
+	if opts.SummaryProblem {
+		counts.reportProblem(block.w)
+	}
+	counts.reportSlow(block.w, opts)
+	counts.check(os.Stderr, summary)
+	if err := opts.scanError(scanner); err != nil {
+		return report, failed, err
+	}
+	return report, failed, unrecognized.err()
+}
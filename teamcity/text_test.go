@@ -0,0 +1,125 @@
+// Copyright (c) 2016 All Rights Reserved, Improbable Worlds Ltd.
+
+package teamcity
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	checkGolden(t, "text", Convert, ErrTestsFailed)
+}
+
+// Each level of subtests is indented further beneath its parent, and each parent is a suite of its subtests
+func TestParseNestedSubtests(t *testing.T) {
+	checkOutline(t, outline(t, Parse, testdata(t, "nested.txt"), DefaultOptions()), `example.com/fix/nested
+  PASS TestTwo (0.00s)
+  TestTwo
+    PASS outer (0.00s)
+    outer
+      PASS inner (0.00s)
+  FAIL TestThree (0.00s): subtest a failed
+  TestThree
+    FAIL a (0.00s): subtest b failed
+    a
+      FAIL b (0.00s): subtest c failed
+      b
+        FAIL c (0.00s, 33 bytes of output): nested_test.go:15: three deep
+        PASS d (0.00s)
+`)
+}
+
+// Where go test was run on Windows, the file a failure or build error points to has backslashes in it
+func TestParseWindowsPaths(t *testing.T) {
+	input := testdata(t, "windows.txt")
+	checkOutline(t, outline(t, Parse, input, DefaultOptions()), `example.com/fix/win
+  FAIL TestWin (0.00s, 42 bytes of output): C:\work\pkg\x_test.go:12: wrong answer
+`)
+	var output strings.Builder
+	if err := Convert(strings.NewReader(input), &output, DefaultOptions()); err != ErrTestsFailed {
+		t.Errorf("got error %v, want %v", err, ErrTestsFailed)
+	}
+	problem := Escape("example.com/fix/broken: failed to build\n# example.com/fix/broken\nC:\\work\\broken\\x.go:3:2: undefined: foo")
+	if !strings.Contains(output.String(), "##teamcity[buildProblem description='"+problem+"'") {
+		t.Errorf("the build failure isn't reported with its diagnostics:\n%s", output.String())
+	}
+}
+
+// Before Go 1.14 a failure's output follows its --- FAIL line, but only until the next test finishes: here a
+// parallel test's, whose --- PASS line doesn't mean what comes after is still the serial test's failure
+func TestParseFailureOutputEndsAtNextFinish(t *testing.T) {
+	input := `=== RUN   TestSerial
+--- FAIL: TestSerial (0.00s)
+    s.go:3: serial broke
+--- PASS: TestPar (0.00s)
+after the parallel one
+FAIL
+FAIL	ex	0.1s
+`
+	checkOutline(t, outline(t, Parse, input, DefaultOptions()), `ex
+  FAIL TestSerial (0.00s, 24 bytes of output): s.go:3: serial broke
+  PASS TestPar (0.00s)
+`)
+}
+
+// A parent that fails only because its subtests did says which, and isn't counted as another failure
+func TestParseFailedThroughSubtests(t *testing.T) {
+	input := `=== RUN   TestP
+=== RUN   TestP/one
+    p_test.go:5: one broke
+=== RUN   TestP/two
+    p_test.go:8: two broke
+--- FAIL: TestP (0.00s)
+    --- FAIL: TestP/one (0.00s)
+    --- FAIL: TestP/two (0.00s)
+=== RUN   TestOwn
+    p_test.go:12: own broke
+=== RUN   TestOwn/sub
+    p_test.go:14: sub broke
+--- FAIL: TestOwn (0.00s)
+    --- FAIL: TestOwn/sub (0.00s)
+FAIL
+FAIL	ex	0.1s
+`
+	checkOutline(t, outline(t, Parse, input, DefaultOptions()), `ex
+  FAIL TestP (0.00s): subtests one, two failed
+  TestP
+    FAIL one (0.00s, 26 bytes of output): p_test.go:5: one broke
+    FAIL two (0.00s, 26 bytes of output): p_test.go:8: two broke
+  FAIL TestOwn (0.00s, 27 bytes of output): p_test.go:12: own broke
+  TestOwn
+    FAIL sub (0.00s, 27 bytes of output): p_test.go:14: sub broke
+`)
+	output := converted(t, Convert, input, DefaultOptions())
+	for _, want := range []string{"key='TestCount' value='4'", "key='FailedTestCount' value='4'"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("missing %s:\n%s", want, output)
+		}
+	}
+}
+
+// Without -json, t.Errorf and t.Log look the same, so the message is the line that reads like a failure, whether
+// something was logged before it or after
+func TestParseFailureMessageBesideLogs(t *testing.T) {
+	input := `=== RUN   TestErrorThenLog
+    a_test.go:29: y failed
+    a_test.go:31: log y
+--- FAIL: TestErrorThenLog (0.00s)
+=== RUN   TestLogThenError
+    a_test.go:40: computing y
+    a_test.go:41: got 3, want 4
+--- FAIL: TestLogThenError (0.00s)
+=== RUN   TestOnlyLogs
+    a_test.go:50: first
+    a_test.go:51: second
+--- FAIL: TestOnlyLogs (0.00s)
+FAIL
+FAIL	ex	0.1s
+`
+	checkOutline(t, outline(t, Parse, input, DefaultOptions()), `ex
+  FAIL TestErrorThenLog (0.00s, 50 bytes of output): a_test.go:29: y failed
+  FAIL TestLogThenError (0.00s, 61 bytes of output): a_test.go:41: got 3, want 4
+  FAIL TestOnlyLogs (0.00s, 48 bytes of output): a_test.go:50: first
+`)
+}